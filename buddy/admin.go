@@ -0,0 +1,162 @@
+package buddy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+// credentialResponse shows a credential without its hash. Password is only
+// set right after it was generated.
+type credentialResponse struct {
+	Suffix    string     `json:"suffix"`
+	Username  string     `json:"username"`
+	Password  string     `json:"password,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt time.Time  `json:"rotated_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newCredentialResponse(credential Credential, password string) credentialResponse {
+	return credentialResponse{
+		Suffix:    credential.Suffix,
+		Username:  credential.Username,
+		Password:  password,
+		CreatedAt: credential.CreatedAt,
+		RotatedAt: credential.RotatedAt,
+		RevokedAt: credential.RevokedAt,
+	}
+}
+
+// authenticateAdmin lets a request through only with the admin credentials
+func (b AppHandler) authenticateAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return b.authenticateBasic("admin", b.Admin.Username, b.Admin.Password, next)
+}
+
+// authenticateMetrics lets a request through only with the metrics credentials
+func (b AppHandler) authenticateMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return b.authenticateBasic("metrics", b.MetricsAuth.Username, b.MetricsAuth.Password, next)
+}
+
+// authenticateDashboardLookup lets a request through only with the dashboard
+// lookup credentials
+func (b AppHandler) authenticateDashboardLookup(next http.HandlerFunc) http.HandlerFunc {
+	return b.authenticateBasic("dashboard-lookup", b.DashboardLookup.Username, b.DashboardLookup.Password, next)
+}
+
+func (b AppHandler) authenticateBasic(realm, expectedUsername, expectedPassword string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+		if !ok || !usernameOK || !passwordOK {
+			b.Logger.Info(realm+"-authentication-failed", lager.Data{"username": username})
+			w.Header().Set("WWW-Authenticate", `Basic realm="buddy-broker-`+realm+`"`)
+			b.respond(w, http.StatusUnauthorized, errorResponse{
+				Description: "Not authorized",
+			})
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (b AppHandler) listCredentials(w http.ResponseWriter, req *http.Request) {
+	credentials, err := b.Credentials.List()
+	if err != nil {
+		b.Logger.Error("credentials-list", err)
+		b.respond(w, http.StatusInternalServerError, errorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	response := []credentialResponse{}
+	for _, credential := range credentials {
+		response = append(response, newCredentialResponse(credential, ""))
+	}
+	b.respond(w, http.StatusOK, response)
+}
+
+func (b AppHandler) createCredential(w http.ResponseWriter, req *http.Request) {
+	suffix := mux.Vars(req)["suffix"]
+	previous, found, err := b.Credentials.Find(suffix)
+	if err != nil {
+		b.Logger.Error("credentials-find", err, lager.Data{"suffix": suffix})
+		b.respond(w, http.StatusInternalServerError, errorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	if found && !previous.revoked() {
+		b.respond(w, http.StatusConflict, errorResponse{
+			Description: fmt.Sprintf("Credentials for suffix %s already exist, rotate them instead", suffix),
+		})
+		return
+	}
+	b.saveCredential(w, suffix, nil, http.StatusCreated)
+}
+
+func (b AppHandler) rotateCredential(w http.ResponseWriter, req *http.Request) {
+	suffix := mux.Vars(req)["suffix"]
+	previous, found, err := b.Credentials.Find(suffix)
+	if err != nil {
+		b.Logger.Error("credentials-find", err, lager.Data{"suffix": suffix})
+		b.respond(w, http.StatusInternalServerError, errorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	if !found || previous.revoked() {
+		b.respond(w, http.StatusNotFound, errorResponse{
+			Description: fmt.Sprintf("No credentials for suffix %s", suffix),
+		})
+		return
+	}
+	b.saveCredential(w, suffix, &previous, http.StatusOK)
+}
+
+func (b AppHandler) saveCredential(w http.ResponseWriter, suffix string, previous *Credential, status int) {
+	credential, password, err := generateCredential(suffix, previous)
+	if err == nil {
+		err = b.Credentials.Save(credential)
+	}
+	if err != nil {
+		b.Logger.Error("credentials-save", err, lager.Data{"suffix": suffix})
+		b.respond(w, http.StatusInternalServerError, errorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	b.Logger.Info("credentials-saved", lager.Data{"suffix": suffix, "rotated": previous != nil})
+	b.respond(w, status, newCredentialResponse(credential, password))
+}
+
+// revokeCredential keeps a tombstone of the credential, so the suffix
+// doesn't fall back to the configured credentials
+func (b AppHandler) revokeCredential(w http.ResponseWriter, req *http.Request) {
+	suffix := mux.Vars(req)["suffix"]
+	credential, found, err := b.Credentials.Find(suffix)
+	found = found && !credential.revoked()
+	if err == nil && found {
+		err = b.Credentials.Save(credential.revoke())
+	}
+	if err != nil {
+		b.Logger.Error("credentials-revoke", err, lager.Data{"suffix": suffix})
+		b.respond(w, http.StatusInternalServerError, errorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	if !found {
+		b.respond(w, http.StatusNotFound, errorResponse{
+			Description: fmt.Sprintf("No credentials for suffix %s", suffix),
+		})
+		return
+	}
+	b.Logger.Info("credentials-revoked", lager.Data{"suffix": suffix})
+	b.respond(w, http.StatusOK, struct{}{})
+}
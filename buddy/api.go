@@ -7,17 +7,54 @@ import (
 	"github.com/pivotal-golang/lager"
 )
 
+// New builds the broker API with the backend brokers of BACKEND_BROKER* env vars
 func New(logger lager.Logger) http.Handler {
-	router := mux.NewRouter()
-	handler := AppHandler{Logger: logger}
+	handler := AppHandler{Logger: logger, Metrics: NewMetrics()}
 	handler.LoadBackendBrokerFromEnv()
-	router.HandleFunc("/{suffix}/v2/catalog", handler.catalog).Methods("GET")
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.provision).Methods("PUT")
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.deprovision).Methods("DELETE")
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/last_operation", handler.lastOperation).Methods("GET")
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.update).Methods("PATCH")
-
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.bind).Methods("PUT")
-	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.unbind).Methods("DELETE")
+	return handler.router()
+}
+
+// NewWithConfig builds the broker API with the backend brokers of a validated config
+func NewWithConfig(logger lager.Logger, config Config) http.Handler {
+	handler := AppHandler{Logger: logger, Metrics: NewMetrics()}
+	handler.UseConfig(config)
+	return handler.router()
+}
+
+func (handler AppHandler) router() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/{suffix}/v2/catalog", handler.route("catalog", AppHandler.catalog)).Methods("GET")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.proxy(provisionProxy)).Methods("PUT")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.proxy(fetchInstanceProxy)).Methods("GET")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.proxy(deprovisionProxy)).Methods("DELETE")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/last_operation", handler.proxy(lastOperationProxy)).Methods("GET")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}", handler.proxy(updateProxy)).Methods("PATCH")
+
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.proxy(bindProxy)).Methods("PUT")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.proxy(fetchBindingProxy)).Methods("GET")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler.proxy(unbindProxy)).Methods("DELETE")
+	router.HandleFunc("/{suffix}/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", handler.proxy(bindingLastOperationProxy)).Methods("GET")
+
+	switch {
+	case handler.MetricsAuth != nil:
+		router.HandleFunc("/metrics", handler.authenticateMetrics(handler.metrics)).Methods("GET")
+	case handler.Admin != nil:
+		router.HandleFunc("/metrics", handler.authenticateAdmin(handler.metrics)).Methods("GET")
+	default:
+		router.HandleFunc("/metrics", handler.metrics).Methods("GET")
+	}
+
+	if handler.Admin != nil && handler.Credentials != nil {
+		router.HandleFunc("/admin/credentials", handler.authenticateAdmin(handler.listCredentials)).Methods("GET")
+		router.HandleFunc("/admin/credentials/{suffix}", handler.authenticateAdmin(handler.createCredential)).Methods("POST")
+		router.HandleFunc("/admin/credentials/{suffix}/rotate", handler.authenticateAdmin(handler.rotateCredential)).Methods("POST")
+		router.HandleFunc("/admin/credentials/{suffix}", handler.authenticateAdmin(handler.revokeCredential)).Methods("DELETE")
+	}
+	if handler.DashboardLookup != nil && handler.DashboardClientMode == suffixDashboardClients {
+		router.HandleFunc("/dashboard_clients/{id}", handler.authenticateDashboardLookup(handler.resolveDashboardClient)).Methods("GET")
+	}
+	if handler.Admin != nil && handler.OrphanMitigation != nil {
+		router.HandleFunc("/admin/orphans", handler.authenticateAdmin(handler.listOrphans)).Methods("GET")
+	}
 	return router
 }
@@ -26,6 +26,56 @@ var _ = Describe("Api", func() {
 		brokerAPI = New(logger)
 	})
 
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	Describe("Test backend routing", func() {
+		var redisBackend *ghttp.Server
+
+		BeforeEach(func() {
+			redisBackend = ghttp.NewServer()
+			os.Setenv("BACKEND_BROKER_REDIS", redisBackend.URL())
+			brokerAPI = New(lager.NewLogger("buddy-api-tests"))
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("BACKEND_BROKER_REDIS")
+			redisBackend.Close()
+		})
+
+		makeRequest := func(suffix string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/"+suffix+"/v2/catalog", nil)
+			brokerAPI.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		It("sends suffixes with a named backend to that backend", func() {
+			redisBackend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/catalog"),
+				ghttp.RespondWith(200, `{"services":[]}`),
+			))
+
+			response := makeRequest("redis-space1")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(redisBackend.ReceivedRequests()).Should(HaveLen(1))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("sends other suffixes to every backend", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"services":[]}`))
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, `{"services":[]}`))
+
+			response := makeRequest("redisish-space1")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+			Ω(redisBackend.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
 	Describe("Test not found", func() {
 		makeRequest := func() *httptest.ResponseRecorder {
 			recorder := httptest.NewRecorder()
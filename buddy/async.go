@@ -0,0 +1,180 @@
+package buddy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	// maxAsyncOperations kept; older operations are dropped
+	maxAsyncOperations   = 1000
+	asyncOperationPrefix = "buddy-"
+)
+
+// asyncOperation is a call buddy answered asynchronously for a backend
+// broker that only answers synchronously
+type asyncOperation struct {
+	instanceID  string
+	bindingID   string
+	state       string
+	description string
+	// binding is the backend's answer to a bind, kept until the platform
+	// fetched it
+	binding json.RawMessage
+}
+
+// asyncOperationLog keeps the latest emulated asynchronous operations in memory
+type asyncOperationLog struct {
+	mutex      sync.Mutex
+	operations map[string]*asyncOperation
+	order      []string
+}
+
+func newAsyncOperationLog() *asyncOperationLog {
+	return &asyncOperationLog{operations: map[string]*asyncOperation{}}
+}
+
+func (l *asyncOperationLog) start(instanceID, bindingID string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	id := asyncOperationPrefix + hex.EncodeToString(randomBytes(8))
+	l.operations[id] = &asyncOperation{instanceID: instanceID, bindingID: bindingID, state: "in progress"}
+	l.order = append(l.order, id)
+	if len(l.order) > maxAsyncOperations {
+		delete(l.operations, l.order[0])
+		l.order = l.order[1:]
+	}
+	return id
+}
+
+func (l *asyncOperationLog) finish(id, state, description string, binding json.RawMessage) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if operation, ok := l.operations[id]; ok {
+		operation.state = state
+		operation.description = description
+		operation.binding = binding
+	}
+}
+
+// find returns a copy of an operation on an instance or binding
+func (l *asyncOperationLog) find(id, instanceID, bindingID string) (asyncOperation, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	operation, ok := l.operations[id]
+	if !ok || operation.instanceID != instanceID || operation.bindingID != bindingID {
+		return asyncOperation{}, false
+	}
+	return *operation, true
+}
+
+// takeBinding hands out the answer to a finished bind once
+func (l *asyncOperationLog) takeBinding(instanceID, bindingID string) (json.RawMessage, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, operation := range l.operations {
+		if operation.instanceID == instanceID && operation.bindingID == bindingID && operation.binding != nil {
+			binding := operation.binding
+			operation.binding = nil
+			return binding, true
+		}
+	}
+	return nil, false
+}
+
+type asyncResponse struct {
+	Operation string `json:"operation"`
+}
+
+type lastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// emulatesAsync is true when a request asks for an asynchronous answer that
+// the backend broker's version can't give
+func (p ReverseProxy) emulatesAsync(backend backendBroker, req *http.Request) bool {
+	return p.EmulateAsync && backend.APIVersion.olderThan(asyncBindingsVersion) && req.URL.Query().Get("accepts_incomplete") == "true"
+}
+
+// serveAsync answers a request with 202 and sends it to the backend broker
+// in the background; the platform polls last_operation for the result
+func (p ReverseProxy) serveAsync(b AppHandler, w http.ResponseWriter, call *Call, req *http.Request) {
+	query := req.URL.Query()
+	query.Del("accepts_incomplete")
+	req.URL.RawQuery = query.Encode()
+	id := b.asyncOperations.start(call.InstanceID, call.BindingID)
+	b.Logger.Info("async-emulation", lager.Data{"operation": id, "backend": call.Backend, "instance_id": call.InstanceID, "binding_id": call.BindingID})
+	go p.finishAsync(b, call, req, id)
+	b.respond(w, http.StatusAccepted, asyncResponse{Operation: id})
+}
+
+func (p ReverseProxy) finishAsync(b AppHandler, call *Call, req *http.Request, id string) {
+	resp, err := b.roundTrip(call.backend, p.Operation, req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if p.MitigateOrphans && needsOrphanMitigation(status, err) {
+		b.mitigateOrphan(orphan{suffix: call.Suffix, instanceID: call.InstanceID, bindingID: call.BindingID, backend: call.backend, details: call.details, header: req.Header, reason: orphanReason(status, err)})
+	}
+	if err != nil {
+		b.Logger.Error("async-emulation-"+p.Operation, err, lager.Data{"operation": id})
+		b.asyncOperations.finish(id, "failed", err.Error(), nil)
+		return
+	}
+	defer resp.Body.Close()
+	for _, rewriter := range p.ResponseRewriters {
+		if err := rewriter.RewriteResponse(call, resp); err != nil {
+			b.Logger.Error("async-emulation-"+p.Operation, err, lager.Data{"operation": id})
+		}
+	}
+	data, err := responseBody(resp)
+	if err != nil {
+		b.asyncOperations.finish(id, "failed", err.Error(), nil)
+		return
+	}
+
+	switch {
+	case status == http.StatusOK || status == http.StatusCreated:
+		var binding json.RawMessage
+		if call.BindingID != "" && p.Operation == "bind" && json.Valid(data) {
+			binding = data
+		}
+		b.asyncOperations.finish(id, "succeeded", "", binding)
+	case status == http.StatusGone && p.Operation == "unbind":
+		b.asyncOperations.finish(id, "succeeded", "", nil)
+	default:
+		var response errorResponse
+		json.Unmarshal(data, &response)
+		if response.Description == "" {
+			response.Description = http.StatusText(status)
+		}
+		b.asyncOperations.finish(id, "failed", response.Description, nil)
+	}
+	b.Logger.Info("async-emulation-done", lager.Data{"operation": id, "status": status})
+}
+
+// emulatedLastOperation answers polls of operations buddy answered
+// asynchronously itself
+var emulatedLastOperation = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	operation, ok := call.handler.asyncOperations.find(req.URL.Query().Get("operation"), call.InstanceID, call.BindingID)
+	if !ok {
+		return nil
+	}
+	return rejection{status: http.StatusOK, response: lastOperationResponse{State: operation.state, Description: operation.description}}
+})
+
+// fetchEmulatedBinding answers the platform's fetch of a binding buddy
+// created asynchronously itself, once, with the backend's answer to the bind
+var fetchEmulatedBinding = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	binding, ok := call.handler.asyncOperations.takeBinding(call.InstanceID, call.BindingID)
+	if !ok {
+		return nil
+	}
+	return rejection{status: http.StatusOK, response: binding}
+})
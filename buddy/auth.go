@@ -0,0 +1,91 @@
+package buddy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+// authenticate lets a request through only with the broker credentials of its
+// suffix: the ones in the credential store, or else the configured ones.
+// Suffixes whose stored credentials were revoked are let through no more.
+// Without Auth, the platform's credentials are passed to the backend broker
+// to check instead.
+func (b AppHandler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if b.Auth == nil {
+			next(w, req)
+			return
+		}
+		suffix := mux.Vars(req)["suffix"]
+		username, password, ok := req.BasicAuth()
+		if !ok || !b.allows(suffix, username, password) {
+			b.Logger.Info("authentication-failed", lager.Data{"suffix": suffix, "username": username})
+			w.Header().Set("WWW-Authenticate", `Basic realm="buddy-broker"`)
+			b.respond(w, http.StatusUnauthorized, errorResponse{
+				Description: "Not authorized",
+			})
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (b AppHandler) allows(suffix, username, password string) bool {
+	if b.Credentials != nil {
+		credential, found, err := b.Credentials.Find(suffix)
+		if err != nil {
+			b.Logger.Error("credentials-find", err, lager.Data{"suffix": suffix})
+			return false
+		}
+		if found {
+			return credential.matches(username, password)
+		}
+	}
+	return b.Auth.allows(suffix, username, password)
+}
+
+// allows checks credentials against the first suffix entry matching the
+// suffix, or the global ones if none does
+func (auth *AuthConfig) allows(suffix, username, password string) bool {
+	expectedUsername, expectedPassword := auth.Username, auth.Password
+	for _, suffixAuth := range auth.Suffixes {
+		if matched, _ := path.Match(suffixAuth.Match, suffix); matched {
+			expectedUsername, expectedPassword = suffixAuth.Username, suffixAuth.Password
+			break
+		}
+	}
+	if expectedUsername == "" {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+	return usernameOK && passwordOK
+}
+
+// backendHeader returns the headers for a backend request. The platform's
+// credentials are replaced with the backend broker's own if it has some, and
+// never passed on when buddy checked them itself. Backend brokers with a
+// configured API version are declared at most that version.
+func (b AppHandler) backendHeader(backend backendBroker, platform http.Header) http.Header {
+	if backend.Username == "" && b.Auth == nil && !backend.APIVersion.known() {
+		return platform
+	}
+	header := http.Header{}
+	for name, values := range platform {
+		header[name] = values
+	}
+	header.Del("Authorization")
+	if backend.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(backend.Username + ":" + backend.Password))
+		header.Set("Authorization", "Basic "+auth)
+	}
+	if backend.APIVersion.known() {
+		header.Set(apiVersionHeader, backendAPIVersion(backend, platform).String())
+	}
+	return header
+}
@@ -0,0 +1,93 @@
+package buddy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Auth", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		config = Config{
+			Backends: []BackendConfig{{Name: "default", URL: backend.URL(), Username: "backend", Password: "backend-secret"}},
+			Auth: &AuthConfig{
+				Username: "buddy",
+				Password: "buddy-secret",
+				Suffixes: []SuffixAuth{{Match: "team-a-*", Username: "team-a", Password: "team-a-secret"}},
+			},
+		}
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-auth-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(suffix, username, password string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/"+suffix+"/v2/catalog", nil)
+		if username != "" {
+			request.SetBasicAuth(username, password)
+		}
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test platform credentials", func() {
+		It("calls the backend with its own credentials", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("backend", "backend-secret"),
+				ghttp.RespondWith(200, `{"services":[]}`),
+			))
+
+			response := makeRequest("space1", "buddy", "buddy-secret")
+
+			Ω(response.Code).Should(Equal(200))
+		})
+
+		It("rejects missing credentials", func() {
+			response := makeRequest("space1", "", "")
+
+			Ω(response.Code).Should(Equal(401))
+			Ω(response.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="buddy-broker"`))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("rejects wrong credentials", func() {
+			response := makeRequest("space1", "buddy", "wrong")
+
+			Ω(response.Code).Should(Equal(401))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("uses the credentials of a matching suffix", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"services":[]}`))
+
+			Ω(makeRequest("team-a-space1", "buddy", "buddy-secret").Code).Should(Equal(401))
+			Ω(makeRequest("team-a-space1", "team-a", "team-a-secret").Code).Should(Equal(200))
+		})
+	})
+
+	Describe("Test validation", func() {
+		It("requires backend credentials", func() {
+			config.Backends[0].Username = ""
+			config.Backends[0].Password = ""
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("credentials are required when buddy checks the platform's credentials itself")))
+		})
+	})
+})
@@ -3,33 +3,135 @@ package buddy
 import (
 	"fmt"
 	"net/url"
-	"os"
+	"path"
+	"sort"
 	"strings"
-
-	"github.com/pivotal-golang/lager"
+	"time"
 )
 
+const backendBrokerEnvPrefix = "BACKEND_BROKER_"
+
 // BackendBroker describes the location/creds for a backend broker providing actual services
 type backendBroker struct {
-	URL string
+	Name     string
+	URL      string
+	Timeout  time.Duration
+	Username string
+	Password string
+	// APIVersion is the OSB API version the backend broker speaks, unknown
+	// when not configured
+	APIVersion apiVersion
+}
+
+// newBackendBroker keeps the path of the backend URL as a prefix for every
+// endpoint and moves credentials embedded in it to Username and Password
+func newBackendBroker(config BackendConfig, defaultTimeout time.Duration) (backendBroker, error) {
+	uri, err := url.Parse(config.URL)
+	if err != nil {
+		return backendBroker{}, fmt.Errorf("Could not parse backend broker %s URL", config.Name)
+	}
+	backend := backendBroker{
+		Name:     config.Name,
+		URL:      fmt.Sprintf("%s://%s%s", uri.Scheme, uri.Host, strings.TrimRight(uri.EscapedPath(), "/")),
+		Timeout:  config.Timeout,
+		Username: config.Username,
+		Password: config.Password,
+	}
+	if uri.User != nil && backend.Username == "" {
+		backend.Username = uri.User.Username()
+		backend.Password, _ = uri.User.Password()
+	}
+	if backend.Timeout == 0 {
+		backend.Timeout = defaultTimeout
+	}
+	if config.APIVersion != "" {
+		if backend.APIVersion, err = parseAPIVersion(config.APIVersion); err != nil {
+			return backendBroker{}, fmt.Errorf("Backend broker %s api_version: %s", config.Name, err)
+		}
+	}
+	return backend, nil
 }
 
 // LoadBackendBrokersFromEnv allows registration of backend brokers via environment variables
 // BACKEND_BROKER=https://hostname1
+// BACKEND_BROKER_REDIS=https://hostname2 serves suffixes "redis" and "redis-*"
 func (b *AppHandler) LoadBackendBrokerFromEnv() {
-	for _, e := range os.Environ() {
-		pair := strings.Split(e, "=")
-		if pair[0] == "BACKEND_BROKER" {
-			backendURI := pair[1]
-			uri, err := url.Parse(backendURI)
-			if err != nil {
-				b.Logger.Error("backend-brokers", fmt.Errorf("Could not parse $%s %s", pair[0], backendURI))
-				continue
+	config := ConfigFromEnv()
+	if err := config.Validate(); err != nil {
+		b.Logger.Error("backend-brokers", err)
+	}
+	b.UseConfig(config)
+}
+
+// backendBrokerName turns the env var part REDIS_CACHE into the suffix prefix redis-cache
+func backendBrokerName(envName string) string {
+	return strings.ToLower(strings.Replace(envName, "_", "-", -1))
+}
+
+// label names a backend broker in messages
+func (bb backendBroker) label() string {
+	if bb.Name == "" {
+		return "default"
+	}
+	return bb.Name
+}
+
+// allBackendBrokers lists the default backend broker, when there is one, and
+// all named ones
+func (b AppHandler) allBackendBrokers() []backendBroker {
+	backends := []backendBroker{}
+	if b.BackendBroker.URL != "" {
+		backends = append(backends, b.BackendBroker)
+	}
+	for _, backend := range b.BackendBrokers {
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// backendBrokersFor picks the backend brokers serving a suffix. The first
+// matching suffix rule wins. Otherwise a named backend serves its own name and
+// any suffix starting with "<name>-"; the longest matching name wins. Any
+// other suffix is served by BACKEND_BROKER together with every named backend,
+// merging their catalogs.
+func (b AppHandler) backendBrokersFor(suffix string) []backendBroker {
+	for _, rule := range b.SuffixRules {
+		if matched, _ := path.Match(rule.Match, suffix); !matched {
+			continue
+		}
+		backends := []backendBroker{}
+		for _, name := range rule.Backends {
+			if name == defaultBackendName && b.BackendBroker.URL != "" {
+				backends = append(backends, b.BackendBroker)
+			} else if backend, ok := b.BackendBrokers[name]; ok {
+				backends = append(backends, backend)
 			}
-			url := fmt.Sprintf("%s://%s", uri.Scheme, uri.Host)
-			backendBroker := backendBroker{URL: url}
-			b.BackendBroker = backendBroker
-			b.Logger.Info("backend-broker", lager.Data{"backend-broker": url})
 		}
+		return backends
+	}
+
+	var found backendBroker
+	names := []string{}
+	for name, backend := range b.BackendBrokers {
+		names = append(names, name)
+		if suffix != name && !strings.HasPrefix(suffix, name+"-") {
+			continue
+		}
+		if len(name) > len(found.Name) {
+			found = backend
+		}
+	}
+	if found.URL != "" {
+		return []backendBroker{found}
+	}
+
+	backends := []backendBroker{}
+	if b.BackendBroker.URL != "" {
+		backends = append(backends, b.BackendBroker)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		backends = append(backends, b.BackendBrokers[name])
 	}
+	return backends
 }
@@ -0,0 +1,150 @@
+package buddy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Async bindings", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		tmpDir    string
+		path      string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-bindings")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(tmpDir, "registry.json")
+
+		backend = ghttp.NewServer()
+		os.Setenv("BACKEND_BROKER", backend.URL())
+		os.Setenv("REGISTRY_FILE", path)
+		brokerAPI = New(lager.NewLogger("buddy-binding-tests"))
+
+		backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("PUT", "/space1/v2/service_instances/instance1",
+			bytes.NewBufferString(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+		brokerAPI.ServeHTTP(recorder, request)
+		Ω(recorder.Code).Should(Equal(201))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("REGISTRY_FILE")
+		backend.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	bindings := func() []Record {
+		registry, err := NewFileRegistry(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		records, err := registry.List()
+		Ω(err).ShouldNot(HaveOccurred())
+		bindings := []Record{}
+		for _, record := range records {
+			if record.BindingID != "" {
+				bindings = append(bindings, record)
+			}
+		}
+		return bindings
+	}
+
+	Describe("Test bind", func() {
+		It("forwards accepts_incomplete and the backend's 202", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1/service_bindings/binding1", "accepts_incomplete=true"),
+				ghttp.RespondWith(202, `{"operation":"bind-1"}`),
+			))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1?accepts_incomplete=true",
+				`{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Code).Should(Equal(202))
+			Ω(response.Body).Should(MatchJSON(`{"operation":"bind-1"}`))
+			Ω(bindings()).Should(HaveLen(1))
+		})
+
+		It("polls the binding's last operation", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/service_instances/instance1/service_bindings/binding1/last_operation",
+					"operation=bind-1&plan_id=small&service_id=redis"),
+				ghttp.RespondWith(200, `{"state":"in progress"}`),
+			))
+
+			response := makeRequest("GET",
+				"/space1/v2/service_instances/instance1/service_bindings/binding1/last_operation?service_id=redis-space1&plan_id=small-space1&operation=bind-1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"state":"in progress"}`))
+		})
+
+		It("doesn't poll bindings of instances of other suffixes", func() {
+			response := makeRequest("GET", "/space2/v2/service_instances/instance1/service_bindings/binding1/last_operation", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Test unbind", func() {
+		BeforeEach(func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1",
+				`{"service_id":"redis-space1","plan_id":"small-space1"}`).Code).Should(Equal(201))
+		})
+
+		It("removes asynchronously unbound bindings once the backend is done", func() {
+			backend.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1/service_bindings/binding1",
+						"accepts_incomplete=true&plan_id=small&service_id=redis"),
+					ghttp.RespondWith(202, `{"operation":"unbind-1"}`),
+				),
+				ghttp.RespondWith(200, `{"state":"in progress"}`),
+				ghttp.RespondWith(200, `{"state":"succeeded"}`),
+			)
+
+			response := makeRequest("DELETE",
+				"/space1/v2/service_instances/instance1/service_bindings/binding1?accepts_incomplete=true&service_id=redis-space1&plan_id=small-space1", "")
+			Ω(response.Code).Should(Equal(202))
+			Ω(response.Body).Should(MatchJSON(`{"operation":"unbind-1"}`))
+			Ω(bindings()).Should(HaveLen(1))
+			Ω(bindings()[0].Deprovisioning).Should(BeTrue())
+
+			makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1/last_operation?operation=unbind-1", "")
+			Ω(bindings()).Should(HaveLen(1))
+
+			makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1/last_operation?operation=unbind-1", "")
+			Ω(bindings()).Should(BeEmpty())
+		})
+
+		It("keeps bindings the backend is still binding", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"state":"succeeded"}`))
+
+			makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1/last_operation", "")
+
+			Ω(bindings()).Should(HaveLen(1))
+		})
+	})
+})
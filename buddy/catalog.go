@@ -0,0 +1,320 @@
+package buddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// rawObject is a JSON object whose fields are kept as the backend broker sent them
+type rawObject map[string]json.RawMessage
+
+func (o rawObject) stringField(name string) string {
+	var value string
+	json.Unmarshal(o[name], &value)
+	return value
+}
+
+func (o rawObject) setStringField(name, value string) {
+	o[name], _ = json.Marshal(value)
+}
+
+// rawCatalog is a catalog that only understands service and plan IDs and
+// names, so fields unknown to buddy pass through untouched
+type rawCatalog struct {
+	Fields   rawObject
+	Services []rawService
+}
+
+type rawService struct {
+	Fields rawObject
+	Plans  []rawObject
+}
+
+func parseCatalog(data []byte) (rawCatalog, error) {
+	var catalog rawCatalog
+	if err := json.Unmarshal(data, &catalog.Fields); err != nil {
+		return catalog, err
+	}
+	if catalog.Fields == nil {
+		return catalog, errors.New("Catalog must be an object")
+	}
+	var services []rawObject
+	if raw, ok := catalog.Fields["services"]; ok {
+		if err := json.Unmarshal(raw, &services); err != nil {
+			return catalog, fmt.Errorf("Catalog services: %s", err)
+		}
+	}
+	for _, fields := range services {
+		service := rawService{Fields: fields}
+		if raw, ok := fields["plans"]; ok {
+			if err := json.Unmarshal(raw, &service.Plans); err != nil {
+				return catalog, fmt.Errorf("Catalog plans of service %s: %s", fields.stringField("id"), err)
+			}
+		}
+		catalog.Services = append(catalog.Services, service)
+	}
+	return catalog, nil
+}
+
+// MarshalJSON puts the services back into the catalog fields
+func (catalog rawCatalog) MarshalJSON() ([]byte, error) {
+	fields := rawObject{}
+	for name, raw := range catalog.Fields {
+		fields[name] = raw
+	}
+	services := make([]rawObject, len(catalog.Services))
+	for i, service := range catalog.Services {
+		services[i] = rawObject{}
+		for name, raw := range service.Fields {
+			services[i][name] = raw
+		}
+		if service.Plans != nil {
+			plans, err := marshalJSON(service.Plans)
+			if err != nil {
+				return nil, err
+			}
+			services[i]["plans"] = plans
+		}
+	}
+	raw, err := marshalJSON(services)
+	if err != nil {
+		return nil, err
+	}
+	fields["services"] = raw
+	return marshalJSON(fields)
+}
+
+// marshalJSON is json.Marshal without escaping HTML, so raw backend values
+// come out the way they went in
+func marshalJSON(value interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+// catalogResult is the catalog of one backend broker, or why it could not be fetched
+type catalogResult struct {
+	Catalog rawCatalog
+	Status  int
+	// BackendStatus is what the backend broker answered, 0 when it could
+	// not be reached
+	BackendStatus int
+	Err           error
+}
+
+// fetchCatalog asks a single backend broker for its catalog
+func (b AppHandler) fetchCatalog(backend backendBroker, header http.Header) catalogResult {
+	url := fmt.Sprintf("%s/v2/catalog", backend.URL)
+	backendReq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		b.Logger.Error("backend-catalog-req", err)
+		return catalogResult{Status: http.StatusInternalServerError, Err: err}
+	}
+	backendReq.Header = b.backendHeader(backend, header)
+
+	status, jsonData, err := b.callBackend(backend, "catalog", backendReq)
+	if err != nil {
+		b.Logger.Error("backend-catalog-resp", err, lager.Data{"backend": backend.label()})
+		if _, ok := err.(circuitOpenError); ok {
+			return catalogResult{Status: http.StatusServiceUnavailable, Err: err}
+		}
+		return catalogResult{Status: http.StatusInternalServerError, Err: err}
+	}
+	if status == http.StatusUnauthorized {
+		return catalogResult{Status: http.StatusUnauthorized, BackendStatus: status, Err: errors.New("Not authorized")}
+	}
+	if status != http.StatusOK {
+		err := fmt.Errorf("Backend broker %s answered the catalog request with %d: %s", backend.label(), status, backendDescription(jsonData))
+		b.Logger.Error("backend-catalog-status", err, lager.Data{"backend": backend.label()})
+		if status == http.StatusServiceUnavailable {
+			return catalogResult{Status: http.StatusServiceUnavailable, BackendStatus: status, Err: err}
+		}
+		return catalogResult{Status: http.StatusBadGateway, BackendStatus: status, Err: err}
+	}
+
+	b.Logger.Debug("backend-catalog", lager.Data{"backend": backend.label(), "catalog": json.RawMessage(jsonData)})
+	catalog, err := parseCatalog(jsonData)
+	if err != nil {
+		return catalogResult{Status: http.StatusInternalServerError, BackendStatus: status, Err: err}
+	}
+	return catalogResult{Catalog: catalog, Status: status, BackendStatus: status}
+}
+
+// backendDescription is the description of a backend broker's error
+// response, or the response itself when it has none
+func backendDescription(data []byte) string {
+	var response rawObject
+	if json.Unmarshal(data, &response) == nil && response.stringField("description") != "" {
+		return response.stringField("description")
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// fetchCatalogs asks all backend brokers for their catalogs at once. Results
+// are in the same order as backends.
+func (b AppHandler) fetchCatalogs(backends []backendBroker, header http.Header) []catalogResult {
+	results := make([]catalogResult, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend backendBroker) {
+			defer wg.Done()
+			results[i] = b.fetchCatalog(backend, header)
+		}(i, backend)
+	}
+	wg.Wait()
+	return results
+}
+
+// mergeCatalogs gives the service and plan IDs of each backend catalog the
+// IDs of the suffix, suffixes the service names, rewrites the dashboard
+// clients, translates the services to the platform's API version and merges
+// them into one catalog. IDs and names must stay unique across backends.
+// Everything else of the services is passed through as is, and so are the
+// top-level fields of a single backend's catalog; there is no telling which
+// backend's top-level fields a merged catalog should have.
+func (b AppHandler) mergeCatalogs(backends []backendBroker, results []catalogResult, suffix string, platform apiVersion) (rawCatalog, error) {
+	merged := rawCatalog{Fields: rawObject{}, Services: []rawService{}}
+	if len(results) == 1 {
+		merged.Fields = results[0].Catalog.Fields
+	}
+	serviceIDs := map[string]string{}
+	serviceNames := map[string]string{}
+	planIDs := map[string]string{}
+	claim := func(claimed map[string]string, kind, value string, backend backendBroker) error {
+		if owner, ok := claimed[value]; ok {
+			return fmt.Errorf("%s %s is offered by backend brokers %s and %s", kind, value, owner, backend.label())
+		}
+		claimed[value] = backend.label()
+		return nil
+	}
+
+	for i, result := range results {
+		backend := backends[i]
+		for _, service := range result.Catalog.Services {
+			fields := rawObject{}
+			for name, raw := range service.Fields {
+				fields[name] = raw
+			}
+			serviceID := service.Fields.stringField("id")
+			fields.setStringField("id", b.IDs.SuffixID(suffix, serviceID))
+			fields.setStringField("name", service.Fields.stringField("name")+"-"+suffix)
+			if err := claim(serviceIDs, "Service ID", fields.stringField("id"), backend); err != nil {
+				return merged, err
+			}
+			if err := claim(serviceNames, "Service name", fields.stringField("name"), backend); err != nil {
+				return merged, err
+			}
+			if err := b.rewriteDashboardClient(fields, suffix, serviceID); err != nil {
+				return merged, err
+			}
+
+			var plans []rawObject
+			if service.Plans != nil {
+				plans = make([]rawObject, len(service.Plans))
+			}
+			for j, plan := range service.Plans {
+				plans[j] = rawObject{}
+				for name, raw := range plan {
+					plans[j][name] = raw
+				}
+				plans[j].setStringField("id", b.IDs.SuffixID(suffix, plan.stringField("id")))
+				if err := claim(planIDs, "Plan ID", plans[j].stringField("id"), backend); err != nil {
+					return merged, err
+				}
+			}
+			b.translateCatalogService(fields, plans, backend, platform)
+			merged.Services = append(merged.Services, rawService{Fields: fields, Plans: plans})
+		}
+	}
+	return merged, nil
+}
+
+// catalogOwner returns the index of the catalog offering the backend
+// service, or failing that the plan
+func catalogOwner(results []catalogResult, serviceID, planID string) (int, bool) {
+	for i, result := range results {
+		for _, service := range result.Catalog.Services {
+			if serviceID != "" && service.Fields.stringField("id") == serviceID {
+				return i, true
+			}
+		}
+	}
+	for i, result := range results {
+		for _, service := range result.Catalog.Services {
+			for _, plan := range service.Plans {
+				if planID != "" && plan.stringField("id") == planID {
+					return i, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// ownerBackendBroker picks the backend broker for a suffix that holds the
+// instance according to the registry, or else offers the requested
+// service_id/plan_id, rejecting the request if there is none. Suffixes served
+// by a single backend broker skip both lookups; only instances buddy has no
+// record of need the catalogs.
+func (b AppHandler) ownerBackendBroker(req *http.Request, suffix, instanceID, serviceID, planID string) (backendBroker, error) {
+	backends := b.backendBrokersFor(suffix)
+	if len(backends) == 0 {
+		return backendBroker{}, b.noBackendBroker(suffix)
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	if backend, ok := b.recordedBackendBroker(backends, suffix, instanceID); ok {
+		return backend, nil
+	}
+	if serviceID == "" && planID == "" {
+		return backendBroker{}, rejectf(http.StatusBadRequest, "service_id or plan_id is required to pick a backend broker")
+	}
+
+	results := b.fetchCatalogs(backends, req.Header)
+	for i, result := range results {
+		if result.Err != nil {
+			b.Logger.Error("backend-owner-catalog", result.Err)
+			return backendBroker{}, rejectf(result.Status, "Could not fetch catalog of backend broker %s: %s", backends[i].label(), result.Err)
+		}
+	}
+	owner, ok := catalogOwner(results, serviceID, planID)
+	if !ok {
+		return backendBroker{}, rejectf(http.StatusBadRequest, "No backend broker offers service %s plan %s", serviceID, planID)
+	}
+	return backends[owner], nil
+}
+
+// recordedBackendBroker finds the backend broker the registry recorded for
+// an instance of the suffix
+func (b AppHandler) recordedBackendBroker(backends []backendBroker, suffix, instanceID string) (backendBroker, bool) {
+	if b.Registry == nil || instanceID == "" {
+		return backendBroker{}, false
+	}
+	record, found, err := b.Registry.Find(instanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": instanceID})
+		return backendBroker{}, false
+	}
+	if !found || record.Suffix != suffix {
+		return backendBroker{}, false
+	}
+	for _, backend := range backends {
+		if backend.label() == record.Backend {
+			return backend, true
+		}
+	}
+	return backendBroker{}, false
+}
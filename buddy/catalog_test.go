@@ -0,0 +1,174 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Catalog", func() {
+	var (
+		redisBackend    *ghttp.Server
+		postgresBackend *ghttp.Server
+		brokerAPI       http.Handler
+	)
+
+	redisCatalog := `{"services":[{"id":"redis","name":"redis","plans":[{"id":"redis-small","name":"small"}]}]}`
+	postgresCatalog := `{"services":[{"id":"postgres","name":"postgres","plans":[{"id":"postgres-small","name":"small"}]}]}`
+
+	BeforeEach(func() {
+		redisBackend = ghttp.NewServer()
+		postgresBackend = ghttp.NewServer()
+		os.Setenv("BACKEND_BROKER", redisBackend.URL())
+		os.Setenv("BACKEND_BROKER_POSTGRES", postgresBackend.URL())
+		brokerAPI = New(lager.NewLogger("buddy-catalog-tests"))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BACKEND_BROKER_POSTGRES")
+		redisBackend.Close()
+		postgresBackend.Close()
+	})
+
+	makeRequest := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test merged catalog", func() {
+		It("offers the services of every backend with the suffix", func() {
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, redisCatalog))
+			postgresBackend.AppendHandlers(ghttp.RespondWith(200, postgresCatalog))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(200))
+			var catalog brokerapi.CatalogResponse
+			Ω(json.Unmarshal(response.Body.Bytes(), &catalog)).Should(Succeed())
+			Ω(catalog.Services).Should(HaveLen(2))
+			Ω(catalog.Services[0].ID).Should(Equal("redis-space1"))
+			Ω(catalog.Services[0].Plans[0].ID).Should(Equal("redis-small-space1"))
+			Ω(catalog.Services[1].ID).Should(Equal("postgres-space1"))
+			Ω(catalog.Services[1].Plans[0].ID).Should(Equal("postgres-small-space1"))
+		})
+
+		It("passes through fields buddy does not know", func() {
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, `{"services":[{"id":"redis","name":"redis","instances_retrievable":true,"dashboard_client":{"id":"redis-client","redirect_uri":"https://redis.example.com/?a=1&b=<2>"},"plans":[{"id":"redis-small","name":"small","bindable":false,"maintenance_info":{"version":"1.2.3"},"schemas":{"service_instance":{"create":{"parameters":{"$schema":"http://json-schema.org/draft-04/schema#","type":"object"}}}}}]}]}`))
+			postgresBackend.AppendHandlers(ghttp.RespondWith(200, `{"services":[]}`))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body.String()).Should(MatchJSON(`{"services":[{"id":"redis-space1","name":"redis-space1","instances_retrievable":true,"dashboard_client":{"id":"redis-client","redirect_uri":"https://redis.example.com/?a=1&b=<2>"},"plans":[{"id":"redis-small-space1","name":"small","bindable":false,"maintenance_info":{"version":"1.2.3"},"schemas":{"service_instance":{"create":{"parameters":{"$schema":"http://json-schema.org/draft-04/schema#","type":"object"}}}}}]}]}`))
+			Ω(response.Body.String()).Should(ContainSubstring(`"redirect_uri":"https://redis.example.com/?a=1&b=<2>"`))
+		})
+
+		It("refuses services offered by two backends", func() {
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, redisCatalog))
+			postgresBackend.AppendHandlers(ghttp.RespondWith(200, redisCatalog))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(500))
+			Ω(response.Body.String()).Should(ContainSubstring("Service ID redis-space1 is offered by backend brokers default and postgres"))
+		})
+
+		It("passes on backend authorization failures", func() {
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, redisCatalog))
+			postgresBackend.AppendHandlers(ghttp.RespondWith(401, ""))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(401))
+		})
+
+		It("fails when a backend can't serve its catalog", func() {
+			redisBackend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(500, `{"description":"database down"}`))
+			postgresBackend.AppendHandlers(ghttp.RespondWith(200, postgresCatalog))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(502))
+			Ω(response.Body.String()).Should(ContainSubstring("Backend broker default answered the catalog request with 500: database down"))
+			Ω(response.Body.String()).ShouldNot(ContainSubstring("postgres-space1"))
+		})
+
+		It("fails with 503 when a backend is unavailable", func() {
+			redisBackend.AppendHandlers(ghttp.RespondWith(200, redisCatalog))
+			postgresBackend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(503, `{}`))
+
+			response := makeRequest("GET", "/space1/v2/catalog", nil)
+
+			Ω(response.Code).Should(Equal(503))
+		})
+	})
+
+	Describe("Test routing by service", func() {
+		BeforeEach(func() {
+			redisBackend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200, redisCatalog))
+			postgresBackend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200, postgresCatalog))
+		})
+
+		It("provisions on the backend offering the service", func() {
+			postgresBackend.RouteToHandler("PUT", "/v2/service_instances/instance1", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"service_id":"postgres","plan_id":"postgres-small","organization_guid":"org","space_guid":"space"}`),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1",
+				[]byte(`{"service_id":"postgres-space1","plan_id":"postgres-small-space1","organization_guid":"org","space_guid":"space"}`))
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("binds on the backend offering the service", func() {
+			redisBackend.RouteToHandler("PUT", "/v2/service_instances/instance1/service_bindings/binding1", ghttp.RespondWith(201, "{}"))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1",
+				[]byte(`{"service_id":"redis-space1","plan_id":"redis-small-space1"}`))
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("deprovisions on the backend offering the plan", func() {
+			postgresBackend.RouteToHandler("DELETE", "/v2/service_instances/instance1", ghttp.RespondWith(200, "{}"))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1?plan_id=postgres-small-space1", nil)
+
+			Ω(response.Code).Should(Equal(200))
+		})
+
+		It("routes recorded instances by the registry without catalogs", func() {
+			postgresBackend.RouteToHandler("PUT", "/v2/service_instances/instance1", ghttp.RespondWith(201, "{}"))
+			postgresBackend.RouteToHandler("GET", "/v2/service_instances/instance1/last_operation", ghttp.RespondWith(200, `{"state":"succeeded"}`))
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1",
+				[]byte(`{"service_id":"postgres-space1","plan_id":"postgres-small-space1"}`)).Code).Should(Equal(201))
+			redisRequests, postgresRequests := len(redisBackend.ReceivedRequests()), len(postgresBackend.ReceivedRequests())
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1/last_operation", nil)
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(redisBackend.ReceivedRequests()).Should(HaveLen(redisRequests))
+			Ω(postgresBackend.ReceivedRequests()).Should(HaveLen(postgresRequests + 1))
+		})
+
+		It("rejects services no backend offers", func() {
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=mysql-space1", nil)
+
+			Ω(response.Code).Should(Equal(400))
+		})
+	})
+})
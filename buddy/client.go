@@ -0,0 +1,271 @@
+package buddy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// defaultBackendTimeout limits backend calls nothing else limits, retries
+// included. It is below the 60s platforms wait for brokers, so buddy can still
+// answer.
+const defaultBackendTimeout = 50 * time.Second
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryBackoff     = 100 * time.Millisecond
+	defaultBreakerFailures  = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	maxIdleConnsPerBackend  = 20
+	backendDialTimeout      = 10 * time.Second
+	backendIdleConnsTimeout = 90 * time.Second
+)
+
+// operations are the OSB operations buddy proxies, by the names used in
+// logs, metrics and operation_timeouts
+var operations = map[string]bool{
+	"catalog":                true,
+	"provision":              true,
+	"deprovision":            true,
+	"last_operation":         true,
+	"update":                 true,
+	"bind":                   true,
+	"unbind":                 true,
+	"binding_last_operation": true,
+	"fetch_instance":         true,
+	"fetch_binding":          true,
+}
+
+// idempotentOperations may be sent again when a backend broker failed
+var idempotentOperations = map[string]bool{
+	"catalog":                true,
+	"last_operation":         true,
+	"binding_last_operation": true,
+	"fetch_instance":         true,
+	"fetch_binding":          true,
+}
+
+// newBackendTransport returns the connection pool shared by all backend calls
+func newBackendTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   backendDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerBackend,
+		IdleConnTimeout:       backendIdleConnsTimeout,
+		TLSHandshakeTimeout:   backendDialTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// circuitOpenError fails a backend call without sending it
+type circuitOpenError struct {
+	backend    string
+	retryAfter time.Duration
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("Backend broker %s is unavailable, try again later", e.backend)
+}
+
+// timeout is how long a backend broker gets for an operation, all attempts
+// together
+func (b AppHandler) timeout(backend backendBroker, operation string) time.Duration {
+	if timeout, ok := b.OperationTimeouts[operation]; ok && timeout > 0 {
+		return timeout
+	}
+	if backend.Timeout > 0 {
+		return backend.Timeout
+	}
+	return defaultBackendTimeout
+}
+
+// callBackend sends a request to a backend broker and reads its response
+func (b AppHandler) callBackend(backend backendBroker, operation string, req *http.Request) (int, []byte, error) {
+	resp, err := b.roundTrip(backend, operation, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// roundTrip sends a request to a backend broker, leaving the response body
+// to the caller. Idempotent operations are sent again with exponential
+// backoff when the backend broker can't be reached or is unavailable, as
+// long as the timeout of the operation leaves time for it: every attempt
+// only gets what is left of it. Calls to a backend broker whose circuit
+// breaker is open fail right away.
+func (b AppHandler) roundTrip(backend backendBroker, operation string, req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if idempotentOperations[operation] {
+		attempts = b.Retries.Attempts
+	}
+	deadline := time.Now().Add(b.timeout(backend, operation))
+	breaker := b.breakers[backend.label()]
+	for attempt := 1; ; attempt++ {
+		if ok, retryAfter := breaker.allow(); !ok {
+			return nil, circuitOpenError{backend: backend.label(), retryAfter: retryAfter}
+		}
+		resp, err := b.sendBackend(backend, req, deadline)
+		failed := err != nil || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		breaker.record(failed)
+		backoff := time.Duration(float64(b.Retries.Backoff) * math.Pow(2, float64(attempt-1)))
+		if !failed || attempt >= attempts || !time.Now().Add(backoff).Before(deadline) {
+			return resp, err
+		}
+
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		b.Logger.Info("backend-retry", lager.Data{"backend": backend.label(), "operation": operation, "attempt": attempt, "status": status, "backoff": backoff.String()})
+		time.Sleep(backoff)
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendBackend makes one attempt of a backend call. Its deadline covers
+// reading the response body too.
+func (b AppHandler) sendBackend(backend backendBroker, req *http.Request, deadline time.Time) (*http.Response, error) {
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	ctx = context.WithValue(ctx, backendContextKey{}, backend.label())
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelingBody ends the context of a backend call when its response body
+// is closed
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelingBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// rewind returns a request that sends the body of req once more
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	rewound := req.Clone(req.Context())
+	rewound.Body = body
+	return rewound, nil
+}
+
+// backendContextKey tells the transport which backend broker a request is for
+type backendContextKey struct{}
+
+// respondBackendError answers a request whose backend broker failed. Open
+// circuits get a 503 with Retry-After, as OSB asks for unavailable brokers.
+func (b AppHandler) respondBackendError(w http.ResponseWriter, backend backendBroker, action string, err error) {
+	b.observeBackendError(w, backend, err)
+	b.Logger.Error(action, err, lager.Data{"backend": backend.label()})
+	status := http.StatusInternalServerError
+	if open, ok := err.(circuitOpenError); ok {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(open.retryAfter.Seconds()))))
+	}
+	b.respond(w, status, errorResponse{
+		Description: err.Error(),
+	})
+}
+
+// circuitBreaker opens after a number of failed calls in a row, failing all
+// calls for a cooldown. Then it lets one trial call through, which closes it
+// again when it succeeds. A nil circuitBreaker never opens.
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	failures int
+	cooldown time.Duration
+
+	consecutive int
+	open        bool
+	openedAt    time.Time
+	trial       bool
+}
+
+func newCircuitBreaker(failures int, cooldown time.Duration) *circuitBreaker {
+	if failures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{failures: failures, cooldown: cooldown}
+}
+
+// allow says whether a call may be made, and otherwise how long until the
+// next trial
+func (c *circuitBreaker) allow() (bool, time.Duration) {
+	if c == nil {
+		return true, 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.open {
+		return true, 0
+	}
+	elapsed := time.Since(c.openedAt)
+	if elapsed < c.cooldown {
+		return false, c.cooldown - elapsed
+	}
+	if c.trial {
+		return false, c.cooldown
+	}
+	c.trial = true
+	return true, 0
+}
+
+func (c *circuitBreaker) record(failed bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !failed {
+		c.consecutive = 0
+		c.open = false
+		c.trial = false
+		return
+	}
+	c.consecutive++
+	if c.trial || c.consecutive >= c.failures {
+		c.open = true
+		c.openedAt = time.Now()
+		c.trial = false
+	}
+}
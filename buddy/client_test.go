@@ -0,0 +1,195 @@
+package buddy_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Backend client", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		config = Config{
+			Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}},
+			Retries:  &RetryConfig{Attempts: 3, Backoff: time.Millisecond},
+		}
+	})
+
+	JustBeforeEach(func() {
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-client-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	provision := func() *httptest.ResponseRecorder {
+		return makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+	}
+
+	Describe("Test timeouts", func() {
+		BeforeEach(func() {
+			config.OperationTimeouts = map[string]time.Duration{"provision": 50 * time.Millisecond, "catalog": 200 * time.Millisecond}
+		})
+
+		It("gives up on a backend broker that hangs", func() {
+			done := make(chan bool)
+			backend.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				<-done
+			})
+			defer close(done)
+
+			start := time.Now()
+			response := provision()
+
+			Ω(response.Code).Should(Equal(500))
+			Ω(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+		})
+
+		It("limits all attempts of a call together", func() {
+			done := make(chan bool)
+			backend.RouteToHandler("GET", "/v2/catalog", func(w http.ResponseWriter, req *http.Request) {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+				}
+			})
+			defer close(done)
+
+			start := time.Now()
+			response := makeRequest("GET", "/space1/v2/catalog", "")
+
+			Ω(response.Code).Should(Equal(500))
+			Ω(time.Since(start)).Should(BeNumerically("<", 400*time.Millisecond))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Test retries", func() {
+		It("retries idempotent requests a backend broker failed", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(200, `{"services":[]}`),
+			)
+
+			response := makeRequest("GET", "/space1/v2/catalog", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("gives up after the configured attempts", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(503, "{}"),
+			)
+
+			makeRequest("GET", "/space1/v2/catalog", "")
+
+			Ω(backend.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("sends the body again", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(503, "{}"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyBody([]byte(`{"extra":"data"}`)),
+					ghttp.RespondWith(200, `{"state":"succeeded"}`),
+				),
+			)
+			provision()
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1/last_operation", `{"extra":"data"}`)
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("does not retry requests that are not idempotent", func() {
+			backend.AppendHandlers(ghttp.RespondWith(503, "{}"))
+
+			response := provision()
+
+			Ω(response.Code).Should(Equal(503))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Test circuit breaker", func() {
+		BeforeEach(func() {
+			config.Retries = &RetryConfig{Attempts: 1}
+			config.CircuitBreaker = &CircuitBreakerConfig{Failures: 2, Cooldown: 100 * time.Millisecond}
+		})
+
+		It("stops calling a backend broker that keeps failing", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(503, "{}"),
+			)
+			provision()
+			provision()
+
+			response := provision()
+
+			Ω(response.Code).Should(Equal(503))
+			Ω(response.Header().Get("Retry-After")).Should(Equal("1"))
+			Ω(response.Body.String()).Should(ContainSubstring("Backend broker redis is unavailable"))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("calls the backend broker again after the cooldown", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(201, "{}"),
+			)
+			provision()
+			provision()
+			time.Sleep(150 * time.Millisecond)
+
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance2", `{"service_id":"redis-space1","plan_id":"small-space1"}`).Code).Should(Equal(201))
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance3", `{"service_id":"redis-space1","plan_id":"small-space1"}`).Code).Should(Equal(201))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(4))
+		})
+	})
+
+	Describe("Test config", func() {
+		It("rejects unknown operations and invalid retries", func() {
+			config.OperationTimeouts = map[string]time.Duration{"provisoin": time.Second}
+			config.Retries = &RetryConfig{Attempts: 0}
+			config.CircuitBreaker = &CircuitBreakerConfig{Failures: -1}
+
+			err := config.Validate()
+
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring(`operation_timeouts: unknown operation "provisoin"`))
+			Ω(err.Error()).Should(ContainSubstring("retries: attempts must be at least 1"))
+			Ω(err.Error()).Should(ContainSubstring("circuit_breaker: failures must not be negative"))
+		})
+	})
+})
@@ -0,0 +1,594 @@
+package buddy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultBackendName is the config name of the backend broker serving
+// suffixes no other backend or rule claims, $BACKEND_BROKER in the environment
+const defaultBackendName = "default"
+
+var backendNamePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Config declares the backend brokers and how suffixes are routed to them.
+// It is read from a YAML or JSON file, or built from BACKEND_BROKER* env vars.
+type Config struct {
+	Backends []BackendConfig `yaml:"backends"`
+	// Suffixes are checked in order before the backend names; the first
+	// matching rule picks the backends of a suffix
+	Suffixes []SuffixRule `yaml:"suffixes"`
+	// Timeout limits backend requests of backends without their own timeout
+	Timeout time.Duration `yaml:"timeout"`
+	// Auth makes buddy check the platform's broker credentials itself. Without
+	// it they are passed on to the backend brokers.
+	Auth *AuthConfig `yaml:"auth"`
+	// Admin enables the admin API managing the credential store
+	Admin *AdminConfig `yaml:"admin"`
+	// Metrics are the credentials of /metrics, which otherwise needs the
+	// admin credentials, or none without admin
+	Metrics *MetricsConfig `yaml:"metrics"`
+	// DashboardLookup are the read-only credentials backend dashboards use to
+	// map suffixed dashboard client IDs back, with dashboard_clients: suffix
+	DashboardLookup *DashboardLookupConfig `yaml:"dashboard_lookup"`
+	// LogLevel is debug, info (the default), error or fatal
+	LogLevel string `yaml:"log_level"`
+	// Redact are the JSON paths masked in the logs, DefaultRedactPaths when
+	// not set
+	Redact []string `yaml:"redact"`
+	// Tracing exports a span for every request and backend call
+	Tracing *TracingConfig `yaml:"tracing"`
+	// OperationTimeouts limit the backend requests of an OSB operation, e.g.
+	// catalog, over the backend timeouts
+	OperationTimeouts map[string]time.Duration `yaml:"operation_timeouts"`
+	// Retries send idempotent backend requests again when they failed
+	Retries *RetryConfig `yaml:"retries"`
+	// CircuitBreaker stops calling a backend broker that keeps failing
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// IDStrategy is how service and plan IDs are made unique per suffix:
+	// suffix (the default) appends "-<suffix>", uuid derives a UUID
+	IDStrategy string `yaml:"id_strategy"`
+	// DashboardClients is what happens to the dashboard_client of services:
+	// keep (the default) passes it on, suffix appends "-<suffix>" to its id,
+	// drop removes it
+	DashboardClients string `yaml:"dashboard_clients"`
+	// OrphanMitigation deletes what a backend broker may have created when a
+	// provision or bind failed
+	OrphanMitigation *OrphanMitigationConfig `yaml:"orphan_mitigation"`
+	// Registry says where buddy keeps its records of instances and bindings,
+	// and how strictly it keeps suffixes apart
+	Registry *RegistryConfig `yaml:"registry"`
+}
+
+// RegistryConfig says where the instance registry is kept
+type RegistryConfig struct {
+	// File persists the records; without it they are kept in memory
+	File string `yaml:"file"`
+	// StrictIsolation rejects requests for instances buddy has no record of.
+	// It is on by default when the records are persisted in File, and can't
+	// be turned on without it: an in-memory registry forgets every instance
+	// on restart.
+	StrictIsolation *bool `yaml:"strict_isolation"`
+}
+
+// strict tells whether instances without a record are rejected
+func (c *RegistryConfig) strict() bool {
+	if c == nil {
+		return false
+	}
+	if c.StrictIsolation != nil {
+		return *c.StrictIsolation
+	}
+	return c.File != ""
+}
+
+// RetryConfig says how often idempotent backend requests are sent. The wait
+// before each retry doubles, starting at Backoff.
+type RetryConfig struct {
+	// Attempts counts the first request too; 1 disables retries
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+// CircuitBreakerConfig says when calls to a failing backend broker stop
+type CircuitBreakerConfig struct {
+	// Failures in a row open the circuit; 0 disables the circuit breaker
+	Failures int `yaml:"failures"`
+	// Cooldown is how long an open circuit fails calls before trying again
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// OrphanMitigationConfig says how often buddy tries to delete an orphan. The
+// wait before each retry doubles, starting at Backoff. Zero values pick the
+// defaults of 5 attempts and 1s.
+type OrphanMitigationConfig struct {
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+// TracingConfig says where spans go
+type TracingConfig struct {
+	// Output is stdout or the path of a file spans are appended to
+	Output string `yaml:"output"`
+}
+
+// AdminConfig are the credentials of the admin API
+type AdminConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// MetricsConfig are the credentials of the metrics endpoint
+type MetricsConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// DashboardLookupConfig are the credentials of the dashboard client lookup
+type DashboardLookupConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// AuthConfig are the broker credentials platforms register buddy with
+type AuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Suffixes override the credentials for suffixes matching a glob pattern;
+	// the first match wins
+	Suffixes []SuffixAuth `yaml:"suffixes"`
+	// CredentialsFile keeps generated per-suffix credentials, which take
+	// precedence over all of the above
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// SuffixAuth are the broker credentials of suffixes matching a glob pattern
+type SuffixAuth struct {
+	Match    string `yaml:"match"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// BackendConfig declares a backend broker. A backend serves the suffix of its
+// name and any suffix starting with "<name>-"; the backend named "default"
+// serves the rest together with all others.
+type BackendConfig struct {
+	Name string `yaml:"name"`
+	// URL may have a path, which prefixes every endpoint, and credentials
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Username and Password replace the platform's credentials on backend requests
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// APIVersion is the OSB API version the backend speaks, e.g. 2.13. Buddy
+	// then declares at most this version to it and emulates newer features.
+	APIVersion string `yaml:"api_version"`
+}
+
+// SuffixRule sends the suffixes matching a glob pattern, e.g. "team-a-*", to backends
+type SuffixRule struct {
+	Match    string   `yaml:"match"`
+	Backends []string `yaml:"backends"`
+}
+
+// LoadConfig reads and validates a config file. Unknown fields are errors, so
+// typos don't silently fall back to defaults.
+func LoadConfig(filename string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", filename, err)
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("%s: %s", filename, err)
+	}
+	return config, nil
+}
+
+// ConfigFromEnv builds a config from environment variables
+// BACKEND_BROKER=https://hostname1
+// BACKEND_BROKER_REDIS=https://hostname2 serves suffixes "redis" and "redis-*"
+// BROKER_USERNAME=buddy BROKER_PASSWORD=secret are buddy's own broker credentials
+// CREDENTIALS_FILE=/path/to/credentials.json keeps per-suffix credentials
+// ADMIN_USERNAME=admin ADMIN_PASSWORD=secret enable the admin API
+// METRICS_USERNAME=prometheus METRICS_PASSWORD=secret protect /metrics
+// DASHBOARD_LOOKUP_USERNAME=dashboard DASHBOARD_LOOKUP_PASSWORD=secret enable
+// the dashboard client lookup
+// LOG_LEVEL=debug and LOG_REDACT=parameters,credentials configure the logs
+// TRACING_OUTPUT=stdout or TRACING_OUTPUT=/path/to/spans.json exports spans
+// ID_STRATEGY=uuid gives suffixes UUIDs as service and plan IDs
+// DASHBOARD_CLIENTS=suffix makes dashboard client IDs unique per suffix
+// ORPHAN_MITIGATION=true deletes orphans of failed provisions and binds
+// REGISTRY_FILE=/path/to/registry.json persists the instance registry
+// STRICT_ISOLATION=false lets requests for instances without a record through,
+// STRICT_ISOLATION=true rejects them; the default is true with REGISTRY_FILE
+func ConfigFromEnv() Config {
+	var config Config
+	config.LogLevel = os.Getenv("LOG_LEVEL")
+	if redact := os.Getenv("LOG_REDACT"); redact != "" {
+		config.Redact = strings.Split(redact, ",")
+	}
+	if output := os.Getenv("TRACING_OUTPUT"); output != "" {
+		config.Tracing = &TracingConfig{Output: output}
+	}
+	config.IDStrategy = os.Getenv("ID_STRATEGY")
+	config.DashboardClients = os.Getenv("DASHBOARD_CLIENTS")
+	if os.Getenv("ORPHAN_MITIGATION") == "true" {
+		config.OrphanMitigation = &OrphanMitigationConfig{}
+	}
+	if os.Getenv("REGISTRY_FILE") != "" || os.Getenv("STRICT_ISOLATION") != "" {
+		config.Registry = &RegistryConfig{File: os.Getenv("REGISTRY_FILE")}
+		if os.Getenv("STRICT_ISOLATION") != "" {
+			strict := os.Getenv("STRICT_ISOLATION") != "false"
+			config.Registry.StrictIsolation = &strict
+		}
+	}
+	if os.Getenv("BROKER_USERNAME") != "" || os.Getenv("BROKER_PASSWORD") != "" || os.Getenv("CREDENTIALS_FILE") != "" {
+		config.Auth = &AuthConfig{
+			Username:        os.Getenv("BROKER_USERNAME"),
+			Password:        os.Getenv("BROKER_PASSWORD"),
+			CredentialsFile: os.Getenv("CREDENTIALS_FILE"),
+		}
+	}
+	if os.Getenv("ADMIN_USERNAME") != "" || os.Getenv("ADMIN_PASSWORD") != "" {
+		config.Admin = &AdminConfig{
+			Username: os.Getenv("ADMIN_USERNAME"),
+			Password: os.Getenv("ADMIN_PASSWORD"),
+		}
+	}
+	if os.Getenv("METRICS_USERNAME") != "" || os.Getenv("METRICS_PASSWORD") != "" {
+		config.Metrics = &MetricsConfig{
+			Username: os.Getenv("METRICS_USERNAME"),
+			Password: os.Getenv("METRICS_PASSWORD"),
+		}
+	}
+	if os.Getenv("DASHBOARD_LOOKUP_USERNAME") != "" || os.Getenv("DASHBOARD_LOOKUP_PASSWORD") != "" {
+		config.DashboardLookup = &DashboardLookupConfig{
+			Username: os.Getenv("DASHBOARD_LOOKUP_USERNAME"),
+			Password: os.Getenv("DASHBOARD_LOOKUP_PASSWORD"),
+		}
+	}
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		switch {
+		case pair[0] == "BACKEND_BROKER":
+			config.Backends = append(config.Backends, BackendConfig{Name: defaultBackendName, URL: pair[1]})
+		case strings.HasPrefix(pair[0], backendBrokerEnvPrefix):
+			name := backendBrokerName(strings.TrimPrefix(pair[0], backendBrokerEnvPrefix))
+			config.Backends = append(config.Backends, BackendConfig{Name: name, URL: pair[1]})
+		}
+	}
+	sort.Slice(config.Backends, func(i, j int) bool {
+		return config.Backends[i].Name < config.Backends[j].Name
+	})
+	return config
+}
+
+// ConfigError lists every problem found in a config
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the whole config and reports all problems at once
+func (c Config) Validate() error {
+	var problems ConfigError
+	if len(c.Backends) == 0 {
+		problems = append(problems, "no backend brokers, set $BACKEND_BROKER or declare backends")
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, "timeout must not be negative")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := newIDStrategy(c.IDStrategy); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateDashboardClients(c.DashboardClients); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for operation, timeout := range c.OperationTimeouts {
+		if !operations[operation] {
+			problems = append(problems, fmt.Sprintf("operation_timeouts: unknown operation %q", operation))
+		}
+		if timeout < 0 {
+			problems = append(problems, fmt.Sprintf("operation_timeouts: %s must not be negative", operation))
+		}
+	}
+	if c.Retries != nil {
+		if c.Retries.Attempts < 1 {
+			problems = append(problems, "retries: attempts must be at least 1")
+		}
+		if c.Retries.Backoff < 0 {
+			problems = append(problems, "retries: backoff must not be negative")
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if c.CircuitBreaker.Failures < 0 {
+			problems = append(problems, "circuit_breaker: failures must not be negative")
+		}
+		if c.CircuitBreaker.Cooldown < 0 {
+			problems = append(problems, "circuit_breaker: cooldown must not be negative")
+		}
+	}
+	if c.OrphanMitigation != nil {
+		if c.OrphanMitigation.Attempts < 0 {
+			problems = append(problems, "orphan_mitigation: attempts must not be negative")
+		}
+		if c.OrphanMitigation.Backoff < 0 {
+			problems = append(problems, "orphan_mitigation: backoff must not be negative")
+		}
+	}
+	if c.Tracing != nil && c.Tracing.Output == "" {
+		problems = append(problems, "tracing: output is required, stdout or a file path")
+	}
+	for i, path := range c.Redact {
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			problems = append(problems, fmt.Sprintf("redact[%d]: %q is no dot-separated JSON path", i, path))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, backend := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		if backend.Name != "" {
+			field = fmt.Sprintf("backends[%d] (%s)", i, backend.Name)
+		}
+		switch {
+		case backend.Name == "":
+			problems = append(problems, field+": name is required")
+		case !backendNamePattern.MatchString(backend.Name):
+			problems = append(problems, field+": name must be lowercase letters, digits and dashes")
+		case names[backend.Name]:
+			problems = append(problems, field+": name is declared twice")
+		}
+		names[backend.Name] = true
+
+		if err := validateBackendURL(backend.URL); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: url %s", field, err))
+		}
+		if (backend.Username == "") != (backend.Password == "") {
+			problems = append(problems, field+": username and password must be set together")
+		}
+		if uri, err := url.Parse(backend.URL); err == nil && uri.User != nil && backend.Username != "" {
+			problems = append(problems, field+": credentials must be set either in the url or with username and password")
+		}
+		if backend.Timeout < 0 {
+			problems = append(problems, field+": timeout must not be negative")
+		}
+		if backend.APIVersion != "" {
+			if version, err := parseAPIVersion(backend.APIVersion); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: api_version %s", field, err))
+			} else if version.Major != brokerAPIVersion.Major {
+				problems = append(problems, fmt.Sprintf("%s: api_version must be %d.x", field, brokerAPIVersion.Major))
+			}
+		}
+		if c.Auth != nil && backend.Username == "" && !urlHasCredentials(backend.URL) {
+			problems = append(problems, field+": credentials are required when buddy checks the platform's credentials itself")
+		}
+	}
+
+	if c.Auth != nil {
+		problems = append(problems, c.Auth.validate()...)
+	}
+	if c.Admin != nil {
+		if c.Admin.Username == "" || c.Admin.Password == "" {
+			problems = append(problems, "admin: username and password are required")
+		}
+		if c.Auth == nil || c.Auth.CredentialsFile == "" {
+			problems = append(problems, "admin: auth.credentials_file is required for the admin API")
+		}
+	}
+	if c.Metrics != nil && (c.Metrics.Username == "" || c.Metrics.Password == "") {
+		problems = append(problems, "metrics: username and password are required")
+	}
+	if c.DashboardLookup != nil {
+		if c.DashboardLookup.Username == "" || c.DashboardLookup.Password == "" {
+			problems = append(problems, "dashboard_lookup: username and password are required")
+		}
+		if c.DashboardClients != suffixDashboardClients {
+			problems = append(problems, "dashboard_lookup: needs dashboard_clients: suffix")
+		}
+	}
+	if c.Registry != nil && c.Registry.File == "" && c.Registry.strict() {
+		problems = append(problems, "registry: strict_isolation needs a file, an in-memory registry forgets every instance on restart")
+	}
+	if c.Registry != nil && c.Registry.File != "" {
+		if info, err := os.Stat(c.Registry.File); err == nil && info.IsDir() {
+			problems = append(problems, fmt.Sprintf("registry: file %s is a directory", c.Registry.File))
+		} else if info, err := os.Stat(filepath.Dir(c.Registry.File)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("registry: directory of file %s does not exist", c.Registry.File))
+		}
+	}
+
+	for i, rule := range c.Suffixes {
+		field := fmt.Sprintf("suffixes[%d]", i)
+		if rule.Match == "" {
+			problems = append(problems, field+": match is required")
+		} else if _, err := path.Match(rule.Match, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: match %q is not a valid pattern", field, rule.Match))
+		}
+		if len(rule.Backends) == 0 {
+			problems = append(problems, field+": backends are required")
+		}
+		for _, name := range rule.Backends {
+			if !names[name] {
+				problems = append(problems, fmt.Sprintf("%s: backend %s is not declared", field, name))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (auth *AuthConfig) validate() []string {
+	var problems []string
+	if (auth.Username == "") != (auth.Password == "") {
+		problems = append(problems, "auth: username and password must be set together")
+	}
+	if auth.Username == "" && len(auth.Suffixes) == 0 && auth.CredentialsFile == "" {
+		problems = append(problems, "auth: username and password, suffixes or credentials_file are required")
+	}
+	for i, suffixAuth := range auth.Suffixes {
+		field := fmt.Sprintf("auth.suffixes[%d]", i)
+		if suffixAuth.Match == "" {
+			problems = append(problems, field+": match is required")
+		} else if _, err := path.Match(suffixAuth.Match, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: match %q is not a valid pattern", field, suffixAuth.Match))
+		}
+		if suffixAuth.Username == "" || suffixAuth.Password == "" {
+			problems = append(problems, field+": username and password are required")
+		}
+	}
+	return problems
+}
+
+func urlHasCredentials(backendURL string) bool {
+	uri, err := url.Parse(backendURL)
+	return err == nil && uri.User != nil
+}
+
+func validateBackendURL(backendURL string) error {
+	if backendURL == "" {
+		return fmt.Errorf("is required")
+	}
+	uri, err := url.Parse(backendURL)
+	if err != nil {
+		return fmt.Errorf("could not be parsed")
+	}
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return fmt.Errorf("%q must be http or https", uri.Redacted())
+	}
+	if uri.Host == "" {
+		return fmt.Errorf("%q has no host", uri.Redacted())
+	}
+	if uri.RawQuery != "" || uri.Fragment != "" {
+		return fmt.Errorf("%q must not have a query or fragment", uri.Redacted())
+	}
+	if uri.User != nil {
+		if _, ok := uri.User.Password(); !ok {
+			return fmt.Errorf("%q must have a password with its username", uri.Redacted())
+		}
+	}
+	return nil
+}
+
+// UseConfig routes requests to the backend brokers of a config
+func (b *AppHandler) UseConfig(config Config) {
+	b.BackendBroker = backendBroker{}
+	b.BackendBrokers = map[string]backendBroker{}
+	for _, backendConfig := range config.Backends {
+		backend, err := newBackendBroker(backendConfig, config.Timeout)
+		if err != nil {
+			b.Logger.Error("backend-brokers", err)
+			continue
+		}
+		if backend.Name == defaultBackendName {
+			backend.Name = ""
+			b.BackendBroker = backend
+			b.Logger.Info("backend-broker", lager.Data{"backend-broker": backend.URL})
+			continue
+		}
+		b.BackendBrokers[backend.Name] = backend
+		b.Logger.Info("backend-broker", lager.Data{"name": backend.Name, "backend-broker": backend.URL})
+	}
+	b.SuffixRules = config.Suffixes
+	ids, err := newIDStrategy(config.IDStrategy)
+	if err != nil {
+		b.Logger.Error("id-strategy", err)
+		ids = suffixIDs{}
+	}
+	b.IDs = ids
+	b.learntIDs = newLearntSuffixes()
+	if err := validateDashboardClients(config.DashboardClients); err != nil {
+		b.Logger.Error("dashboard-clients", err)
+		config.DashboardClients = ""
+	}
+	b.DashboardClientMode = config.DashboardClients
+	b.asyncOperations = newAsyncOperationLog()
+	b.Auth = config.Auth
+	b.Admin = config.Admin
+	b.MetricsAuth = config.Metrics
+	b.DashboardLookup = config.DashboardLookup
+	if config.Auth != nil && config.Auth.CredentialsFile != "" {
+		credentials, err := NewFileCredentialStore(config.Auth.CredentialsFile)
+		if err != nil {
+			b.Logger.Fatal("credentials-load", err, lager.Data{"path": config.Auth.CredentialsFile})
+		}
+		b.Credentials = credentials
+	}
+	if config.Tracing != nil {
+		b.Tracer = &Tracer{Exporter: NewWriterSpanExporter(os.Stdout)}
+		if config.Tracing.Output != "stdout" {
+			exporter, err := NewFileSpanExporter(config.Tracing.Output)
+			if err != nil {
+				b.Logger.Fatal("tracing-output", err, lager.Data{"path": config.Tracing.Output})
+			}
+			b.Tracer.Exporter = exporter
+		}
+	}
+	b.useBackendClient(config)
+	b.useOrphanMitigation(config)
+	b.useRegistry(config.Registry)
+}
+
+// useBackendClient sets up the shared backend client, its retries and a
+// circuit breaker per backend broker
+func (b *AppHandler) useBackendClient(config Config) {
+	var transport http.RoundTripper = newBackendTransport()
+	if b.Tracer != nil {
+		transport = tracingTransport{tracer: b.Tracer, next: transport}
+	}
+	b.Client = &http.Client{Transport: transport}
+	b.OperationTimeouts = config.OperationTimeouts
+
+	b.Retries = RetryConfig{Attempts: defaultRetryAttempts, Backoff: defaultRetryBackoff}
+	if config.Retries != nil {
+		b.Retries = *config.Retries
+	}
+	breakerConfig := CircuitBreakerConfig{Failures: defaultBreakerFailures, Cooldown: defaultBreakerCooldown}
+	if config.CircuitBreaker != nil {
+		breakerConfig = *config.CircuitBreaker
+	}
+	b.breakers = map[string]*circuitBreaker{}
+	for _, backend := range b.allBackendBrokers() {
+		b.breakers[backend.label()] = newCircuitBreaker(breakerConfig.Failures, breakerConfig.Cooldown)
+	}
+}
+
+// useOrphanMitigation enables orphan mitigation with the defaults filled in
+func (b *AppHandler) useOrphanMitigation(config Config) {
+	b.OrphanMitigation = nil
+	if config.OrphanMitigation == nil {
+		return
+	}
+	mitigation := *config.OrphanMitigation
+	if mitigation.Attempts == 0 {
+		mitigation.Attempts = defaultOrphanAttempts
+	}
+	if mitigation.Backoff == 0 {
+		mitigation.Backoff = defaultOrphanBackoff
+	}
+	b.OrphanMitigation = &mitigation
+	b.orphans = &orphanLog{}
+}
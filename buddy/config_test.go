@@ -0,0 +1,219 @@
+package buddy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Config", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-config")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeConfig := func(name, content string) string {
+		filename := filepath.Join(tmpDir, name)
+		Ω(ioutil.WriteFile(filename, []byte(content), 0600)).Should(Succeed())
+		return filename
+	}
+
+	Describe("Test load config", func() {
+		It("reads YAML", func() {
+			config, err := LoadConfig(writeConfig("config.yml", `
+timeout: 30s
+backends:
+- name: redis
+  url: https://redis.example.com
+  timeout: 5s
+  username: admin
+  password: secret
+suffixes:
+- match: "team-a-*"
+  backends: [redis]
+`))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(config.Timeout).Should(Equal(30 * time.Second))
+			Ω(config.Backends).Should(HaveLen(1))
+			Ω(config.Backends[0].Timeout).Should(Equal(5 * time.Second))
+			Ω(config.Backends[0].Username).Should(Equal("admin"))
+			Ω(config.Suffixes[0].Backends).Should(Equal([]string{"redis"}))
+		})
+
+		It("reads JSON", func() {
+			config, err := LoadConfig(writeConfig("config.json", `{"backends":[{"name":"redis","url":"https://redis.example.com"}]}`))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(config.Backends[0].Name).Should(Equal("redis"))
+		})
+
+		It("rejects unknown fields", func() {
+			_, err := LoadConfig(writeConfig("config.yml", "backends:\n- name: redis\n  uri: https://redis.example.com\n"))
+
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("field uri not found"))
+		})
+
+		It("reports every problem at once", func() {
+			_, err := LoadConfig(writeConfig("config.yml", `
+backends:
+- name: Redis
+  url: ftp://redis.example.com
+- name: postgres
+  url: https://postgres.example.com
+  username: admin
+suffixes:
+- match: "["
+  backends: [mysql]
+`))
+
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("backends[0] (Redis): name must be lowercase letters, digits and dashes"))
+			Ω(err.Error()).Should(ContainSubstring(`backends[0] (Redis): url "ftp://redis.example.com" must be http or https`))
+			Ω(err.Error()).Should(ContainSubstring("backends[1] (postgres): username and password must be set together"))
+			Ω(err.Error()).Should(ContainSubstring(`suffixes[0]: match "[" is not a valid pattern`))
+			Ω(err.Error()).Should(ContainSubstring("suffixes[0]: backend mysql is not declared"))
+		})
+
+		It("reads the registry", func() {
+			config, err := LoadConfig(writeConfig("config.yml", `
+backends:
+- name: redis
+  url: https://redis.example.com
+registry:
+  file: `+filepath.Join(tmpDir, "registry.json")+`
+  strict_isolation: false
+`))
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(config.Registry.File).Should(Equal(filepath.Join(tmpDir, "registry.json")))
+			Ω(*config.Registry.StrictIsolation).Should(BeFalse())
+		})
+
+		It("rejects registry files that can't be written", func() {
+			config := Config{
+				Backends: []BackendConfig{{Name: "redis", URL: "https://redis.example.com"}},
+				Registry: &RegistryConfig{File: tmpDir},
+			}
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("registry: file " + tmpDir + " is a directory")))
+
+			config.Registry.File = filepath.Join(tmpDir, "missing", "registry.json")
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("registry: directory of file " + config.Registry.File + " does not exist")))
+		})
+
+		It("rejects strict isolation without a registry file", func() {
+			strict := true
+			config := Config{
+				Backends: []BackendConfig{{Name: "redis", URL: "https://redis.example.com"}},
+				Registry: &RegistryConfig{StrictIsolation: &strict},
+			}
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("registry: strict_isolation needs a file")))
+		})
+	})
+
+	Describe("Test config from env", func() {
+		AfterEach(func() {
+			os.Unsetenv("BACKEND_BROKER_REDIS")
+			os.Unsetenv("REGISTRY_FILE")
+			os.Unsetenv("STRICT_ISOLATION")
+		})
+
+		It("keeps URLs containing =", func() {
+			os.Setenv("BACKEND_BROKER_REDIS", "https://redis.example.com/?token=abc=")
+
+			config := ConfigFromEnv()
+
+			Ω(config.Backends).Should(ContainElement(BackendConfig{Name: "redis", URL: "https://redis.example.com/?token=abc="}))
+		})
+
+		It("reads the registry", func() {
+			os.Setenv("REGISTRY_FILE", "/var/vcap/store/registry.json")
+
+			config := ConfigFromEnv()
+
+			Ω(config.Registry.File).Should(Equal("/var/vcap/store/registry.json"))
+			Ω(config.Registry.StrictIsolation).Should(BeNil())
+
+			os.Setenv("STRICT_ISOLATION", "false")
+
+			Ω(*ConfigFromEnv().Registry.StrictIsolation).Should(BeFalse())
+		})
+	})
+
+	Describe("Test routing", func() {
+		var (
+			redisBackend    *ghttp.Server
+			postgresBackend *ghttp.Server
+			brokerAPI       http.Handler
+		)
+
+		BeforeEach(func() {
+			redisBackend = ghttp.NewServer()
+			postgresBackend = ghttp.NewServer()
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-config-tests"), Config{
+				Backends: []BackendConfig{
+					{Name: "redis", URL: redisBackend.URL(), Username: "admin", Password: "secret"},
+					{Name: "postgres", URL: postgresBackend.URL()},
+				},
+				Suffixes: []SuffixRule{
+					{Match: "team-a-*", Backends: []string{"postgres"}},
+				},
+			})
+		})
+
+		AfterEach(func() {
+			redisBackend.Close()
+			postgresBackend.Close()
+		})
+
+		makeRequest := func(suffix string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/"+suffix+"/v2/catalog", nil)
+			request.SetBasicAuth("platform", "password")
+			brokerAPI.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		It("sends suffixes matching a rule to its backends", func() {
+			postgresBackend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("platform", "password"),
+				ghttp.RespondWith(200, `{"services":[]}`),
+			))
+
+			response := makeRequest("team-a-redis")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(redisBackend.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("sends the backend's own credentials", func() {
+			redisBackend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("admin", "secret"),
+				ghttp.RespondWith(200, `{"services":[]}`),
+			))
+
+			response := makeRequest("redis-space1")
+
+			Ω(response.Code).Should(Equal(200))
+		})
+	})
+})
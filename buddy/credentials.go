@@ -0,0 +1,203 @@
+package buddy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Credential are the broker credentials of one suffix. Only a salted hash of
+// the password is kept; the password itself is shown once when it is
+// generated. Generated passwords are 256 random bits, so a fast hash is as
+// good as a slow one. A revoked credential is kept without its hash, so the
+// suffix doesn't fall back to the configured credentials.
+type Credential struct {
+	Suffix       string     `json:"suffix"`
+	Username     string     `json:"username"`
+	Salt         string     `json:"salt"`
+	PasswordHash string     `json:"password_hash"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RotatedAt    time.Time  `json:"rotated_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CredentialStore keeps the broker credentials of each suffix
+type CredentialStore interface {
+	Find(suffix string) (Credential, bool, error)
+	Save(credential Credential) error
+	Delete(suffix string) error
+	List() ([]Credential, error)
+}
+
+// generateCredential returns a credential for a suffix with a new random
+// password, keeping the creation time of a credential it rotates
+func generateCredential(suffix string, previous *Credential) (Credential, string, error) {
+	password, err := randomString(32)
+	if err != nil {
+		return Credential{}, "", err
+	}
+	salt, err := randomString(16)
+	if err != nil {
+		return Credential{}, "", err
+	}
+	now := time.Now().UTC()
+	credential := Credential{
+		Suffix:       suffix,
+		Username:     suffix,
+		Salt:         salt,
+		PasswordHash: hashPassword(salt, password),
+		CreatedAt:    now,
+		RotatedAt:    now,
+	}
+	if previous != nil {
+		credential.CreatedAt = previous.CreatedAt
+	}
+	return credential, password, nil
+}
+
+func randomString(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func hashPassword(salt, password string) string {
+	hash := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(hash[:])
+}
+
+// revoke turns a credential into the tombstone of a revoked one
+func (c Credential) revoke() Credential {
+	now := time.Now().UTC()
+	return Credential{
+		Suffix:    c.Suffix,
+		Username:  c.Username,
+		CreatedAt: c.CreatedAt,
+		RotatedAt: c.RotatedAt,
+		RevokedAt: &now,
+	}
+}
+
+func (c Credential) revoked() bool {
+	return c.RevokedAt != nil
+}
+
+func (c Credential) matches(username, password string) bool {
+	if c.revoked() {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(hashPassword(c.Salt, password)), []byte(c.PasswordHash)) == 1
+	return usernameOK && passwordOK
+}
+
+type memoryCredentialStore struct {
+	mutex       sync.RWMutex
+	credentials map[string]Credential
+}
+
+// NewMemoryCredentialStore returns a credential store that forgets everything on restart
+func NewMemoryCredentialStore() CredentialStore {
+	return &memoryCredentialStore{credentials: map[string]Credential{}}
+}
+
+func (s *memoryCredentialStore) Find(suffix string) (Credential, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	credential, ok := s.credentials[suffix]
+	return credential, ok, nil
+}
+
+func (s *memoryCredentialStore) Save(credential Credential) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.credentials[credential.Suffix] = credential
+	return nil
+}
+
+func (s *memoryCredentialStore) Delete(suffix string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.credentials, suffix)
+	return nil
+}
+
+func (s *memoryCredentialStore) List() ([]Credential, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.list(), nil
+}
+
+func (s *memoryCredentialStore) list() []Credential {
+	credentials := []Credential{}
+	for _, credential := range s.credentials {
+		credentials = append(credentials, credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Suffix < credentials[j].Suffix
+	})
+	return credentials
+}
+
+// fileCredentialStore keeps the credentials in memory and writes all of them
+// to a JSON file on every change
+type fileCredentialStore struct {
+	memoryCredentialStore
+	path string
+}
+
+// NewFileCredentialStore returns a credential store persisted in the JSON
+// file at path, loading any credentials already in it
+func NewFileCredentialStore(path string) (CredentialStore, error) {
+	s := &fileCredentialStore{
+		memoryCredentialStore: memoryCredentialStore{credentials: map[string]Credential{}},
+		path:                  path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var credentials []Credential
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+	for _, credential := range credentials {
+		s.credentials[credential.Suffix] = credential
+	}
+	return s, nil
+}
+
+func (s *fileCredentialStore) Save(credential Credential) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.credentials[credential.Suffix] = credential
+	return s.persist()
+}
+
+func (s *fileCredentialStore) Delete(suffix string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.credentials, suffix)
+	return s.persist()
+}
+
+func (s *fileCredentialStore) persist() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, data)
+}
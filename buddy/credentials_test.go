@@ -0,0 +1,177 @@
+package buddy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		tmpDir    string
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-credentials")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend = ghttp.NewServer()
+		backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200, `{"services":[]}`))
+		config = Config{
+			Backends: []BackendConfig{{Name: "default", URL: backend.URL(), Username: "backend", Password: "backend-secret"}},
+			Auth: &AuthConfig{
+				Username:        "buddy",
+				Password:        "buddy-secret",
+				CredentialsFile: filepath.Join(tmpDir, "credentials.json"),
+			},
+			Admin: &AdminConfig{Username: "admin", Password: "admin-secret"},
+		}
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-credentials-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	makeRequest := func(method, path, username, password string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, nil)
+		request.SetBasicAuth(username, password)
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	adminRequest := func(method, path string) *httptest.ResponseRecorder {
+		return makeRequest(method, path, "admin", "admin-secret")
+	}
+
+	generate := func(method, path string) (string, string) {
+		response := adminRequest(method, path)
+		Ω(response.Code).Should(BeNumerically("<", 300))
+		var credential struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		Ω(json.Unmarshal(response.Body.Bytes(), &credential)).Should(Succeed())
+		Ω(credential.Password).ShouldNot(BeEmpty())
+		return credential.Username, credential.Password
+	}
+
+	Describe("Test admin API", func() {
+		It("requires the admin credentials", func() {
+			Ω(makeRequest("GET", "/admin/credentials", "buddy", "buddy-secret").Code).Should(Equal(401))
+			Ω(makeRequest("POST", "/admin/credentials/space1", "admin", "wrong").Code).Should(Equal(401))
+		})
+
+		It("creates credentials once", func() {
+			response := adminRequest("POST", "/admin/credentials/space1")
+			Ω(response.Code).Should(Equal(201))
+			Ω(response.Body.String()).Should(ContainSubstring(`"username":"space1"`))
+
+			Ω(adminRequest("POST", "/admin/credentials/space1").Code).Should(Equal(409))
+		})
+
+		It("lists credentials without secrets", func() {
+			_, password := generate("POST", "/admin/credentials/space1")
+
+			response := adminRequest("GET", "/admin/credentials")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body.String()).Should(ContainSubstring(`"suffix":"space1"`))
+			Ω(response.Body.String()).ShouldNot(ContainSubstring(password))
+			Ω(response.Body.String()).ShouldNot(ContainSubstring("hash"))
+		})
+
+		It("rotates and revokes only existing credentials", func() {
+			Ω(adminRequest("POST", "/admin/credentials/space1/rotate").Code).Should(Equal(404))
+			Ω(adminRequest("DELETE", "/admin/credentials/space1").Code).Should(Equal(404))
+		})
+	})
+
+	Describe("Test per-suffix credentials", func() {
+		It("accepts a suffix's credentials only for that suffix", func() {
+			username, password := generate("POST", "/admin/credentials/space1")
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, password).Code).Should(Equal(200))
+			Ω(makeRequest("GET", "/space2/v2/catalog", username, password).Code).Should(Equal(401))
+		})
+
+		It("replaces the configured credentials of a suffix", func() {
+			generate("POST", "/admin/credentials/space1")
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", "buddy", "buddy-secret").Code).Should(Equal(401))
+			Ω(makeRequest("GET", "/space2/v2/catalog", "buddy", "buddy-secret").Code).Should(Equal(200))
+		})
+
+		It("stops accepting the old password after a rotation", func() {
+			username, oldPassword := generate("POST", "/admin/credentials/space1")
+			_, newPassword := generate("POST", "/admin/credentials/space1/rotate")
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, oldPassword).Code).Should(Equal(401))
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, newPassword).Code).Should(Equal(200))
+		})
+
+		It("denies a suffix after a revocation, across restarts", func() {
+			username, password := generate("POST", "/admin/credentials/space1")
+
+			Ω(adminRequest("DELETE", "/admin/credentials/space1").Code).Should(Equal(200))
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, password).Code).Should(Equal(401))
+			Ω(makeRequest("GET", "/space1/v2/catalog", "buddy", "buddy-secret").Code).Should(Equal(401))
+			Ω(adminRequest("DELETE", "/admin/credentials/space1").Code).Should(Equal(404))
+			Ω(adminRequest("POST", "/admin/credentials/space1/rotate").Code).Should(Equal(404))
+
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-credentials-tests"), config)
+			Ω(makeRequest("GET", "/space1/v2/catalog", "buddy", "buddy-secret").Code).Should(Equal(401))
+		})
+
+		It("creates new credentials for a revoked suffix", func() {
+			generate("POST", "/admin/credentials/space1")
+			Ω(adminRequest("DELETE", "/admin/credentials/space1").Code).Should(Equal(200))
+
+			username, password := generate("POST", "/admin/credentials/space1")
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, password).Code).Should(Equal(200))
+		})
+
+		It("keeps only hashes across restarts", func() {
+			username, password := generate("POST", "/admin/credentials/space1")
+
+			data, err := ioutil.ReadFile(config.Auth.CredentialsFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(data)).ShouldNot(ContainSubstring(password))
+
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-credentials-tests"), config)
+			Ω(makeRequest("GET", "/space1/v2/catalog", username, password).Code).Should(Equal(200))
+		})
+	})
+
+	Describe("Test config", func() {
+		It("requires a credentials file for the admin API", func() {
+			config.Auth.CredentialsFile = ""
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("admin: auth.credentials_file is required")))
+		})
+
+		It("accepts a credentials file as the only broker credentials", func() {
+			config.Auth = &AuthConfig{CredentialsFile: filepath.Join(tmpDir, "credentials.json")}
+
+			Ω(config.Validate()).Should(Succeed())
+		})
+	})
+})
@@ -0,0 +1,121 @@
+package buddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	keepDashboardClients   = "keep"
+	suffixDashboardClients = "suffix"
+	dropDashboardClients   = "drop"
+)
+
+// validateDashboardClients checks a dashboard_clients config value; empty
+// means keep
+func validateDashboardClients(mode string) error {
+	switch mode {
+	case "", keepDashboardClients, suffixDashboardClients, dropDashboardClients:
+		return nil
+	}
+	return fmt.Errorf("dashboard_clients must be %s, %s or %s, not %q", keepDashboardClients, suffixDashboardClients, dropDashboardClients, mode)
+}
+
+// suffixHeader tells backend brokers the suffix of a request, so their
+// dashboards know the suffixed client ID of an instance
+const suffixHeader = "X-Buddy-Suffix"
+
+// DashboardClient is the UAA client a suffix registers for the dashboard of
+// a backend service, with the client ID the backend broker declared
+type DashboardClient struct {
+	ID        string `json:"id"`
+	Suffix    string `json:"suffix"`
+	Backend   string `json:"backend"`
+	ServiceID string `json:"service_id"`
+	BackendID string `json:"backend_id"`
+}
+
+// dashboardClientID is the client ID a suffix registers for the dashboard
+// client a backend broker declared. It only depends on the two, so backend
+// dashboards can derive it without asking buddy.
+func dashboardClientID(backendID, suffix string) string {
+	return backendID + "-" + suffix
+}
+
+// rewriteDashboardClient keeps, suffixes or drops the dashboard_client of a
+// backend service in the catalog of a suffix. UAA client IDs are global, so
+// two suffixes can't register the same one.
+func (b AppHandler) rewriteDashboardClient(fields rawObject, suffix string, serviceID string) error {
+	raw, ok := fields["dashboard_client"]
+	if !ok {
+		return nil
+	}
+	if b.DashboardClientMode == dropDashboardClients {
+		delete(fields, "dashboard_client")
+		return nil
+	}
+	if b.DashboardClientMode != suffixDashboardClients {
+		return nil
+	}
+
+	var client rawObject
+	if err := json.Unmarshal(raw, &client); err != nil {
+		return fmt.Errorf("dashboard_client of service %s: %s", serviceID, err)
+	}
+	backendID := client.stringField("id")
+	if backendID == "" {
+		return nil
+	}
+	client.setStringField("id", dashboardClientID(backendID, suffix))
+	raw, err := marshalJSON(client)
+	if err != nil {
+		return err
+	}
+	fields["dashboard_client"] = raw
+	return nil
+}
+
+// resolveDashboardClient maps a suffixed dashboard client ID back to its
+// suffix, backend, service and original client ID. Every way of splitting
+// the ID into a client ID and a suffix is tried against the catalogs of the
+// backend brokers serving that suffix, longest client ID first. Lookups
+// don't come from the platform, so catalogs are fetched with the credentials
+// configured for each backend broker only.
+func (b AppHandler) resolveDashboardClient(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	for i := strings.LastIndex(id, "-"); i > 0; i = strings.LastIndex(id[:i], "-") {
+		backendID, suffix := id[:i], id[i+1:]
+		for _, backend := range b.backendBrokersFor(suffix) {
+			result := b.fetchCatalog(backend, http.Header{})
+			if result.BackendStatus == http.StatusUnauthorized {
+				b.respondError(w, "dashboard-client-catalog", rejectf(http.StatusBadGateway, "Backend broker %s refused buddy's catalog request; lookups need its username and password in buddy's config", backend.label()))
+				return
+			}
+			if result.Err != nil {
+				b.respondError(w, "dashboard-client-catalog", rejectf(result.Status, "%s: %s", backend.label(), result.Err))
+				return
+			}
+			for _, service := range result.Catalog.Services {
+				var client rawObject
+				json.Unmarshal(service.Fields["dashboard_client"], &client)
+				if client.stringField("id") == backendID {
+					b.respond(w, http.StatusOK, DashboardClient{
+						ID:        id,
+						Suffix:    suffix,
+						Backend:   backend.label(),
+						ServiceID: service.Fields.stringField("id"),
+						BackendID: backendID,
+					})
+					return
+				}
+			}
+		}
+	}
+	b.respond(w, http.StatusNotFound, errorResponse{
+		Description: fmt.Sprintf("No dashboard client %s", id),
+	})
+}
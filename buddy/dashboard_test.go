@@ -0,0 +1,167 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Dashboard clients", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200,
+			`{"services":[{"id":"redis","name":"redis","dashboard_client":{"id":"redis-dashboard","secret":"s3cret","redirect_uri":"https://dashboard.example.com"},"plans":[]}]}`))
+		config = Config{
+			Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}},
+			Admin:    &AdminConfig{Username: "admin", Password: "admin-secret"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-dashboard-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequestAs := func(username, password, method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(""))
+		request.SetBasicAuth(username, password)
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	makeRequest := func(method, path string) *httptest.ResponseRecorder {
+		return makeRequestAs("admin", "admin-secret", method, path)
+	}
+
+	lookup := func(id string) *httptest.ResponseRecorder {
+		return makeRequestAs("dashboard", "lookup-secret", "GET", "/dashboard_clients/"+id)
+	}
+
+	dashboardClient := func(suffix string) json.RawMessage {
+		response := makeRequest("GET", "/"+suffix+"/v2/catalog")
+		Ω(response.Code).Should(Equal(200))
+		var catalog struct {
+			Services []map[string]json.RawMessage `json:"services"`
+		}
+		Ω(json.Unmarshal(response.Body.Bytes(), &catalog)).Should(Succeed())
+		return catalog.Services[0]["dashboard_client"]
+	}
+
+	Describe("Test keep", func() {
+		It("passes dashboard clients on by default", func() {
+			Ω(dashboardClient("space1")).Should(MatchJSON(`{"id":"redis-dashboard","secret":"s3cret","redirect_uri":"https://dashboard.example.com"}`))
+			Ω(lookup("redis-dashboard-space1").Code).Should(Equal(404))
+		})
+	})
+
+	Describe("Test suffix", func() {
+		BeforeEach(func() {
+			config.DashboardClients = "suffix"
+			config.DashboardLookup = &DashboardLookupConfig{Username: "dashboard", Password: "lookup-secret"}
+		})
+
+		It("gives every suffix its own dashboard client ID", func() {
+			Ω(dashboardClient("space1")).Should(MatchJSON(`{"id":"redis-dashboard-space1","secret":"s3cret","redirect_uri":"https://dashboard.example.com"}`))
+			Ω(dashboardClient("space2")).Should(MatchJSON(`{"id":"redis-dashboard-space2","secret":"s3cret","redirect_uri":"https://dashboard.example.com"}`))
+		})
+
+		It("maps dashboard client IDs back without having served the catalog", func() {
+			response := lookup("redis-dashboard-org1-space1")
+
+			Ω(response.Code).Should(Equal(200))
+			var client DashboardClient
+			Ω(json.Unmarshal(response.Body.Bytes(), &client)).Should(Succeed())
+			Ω(client).Should(Equal(DashboardClient{ID: "redis-dashboard-org1-space1", Suffix: "org1-space1", Backend: "redis", ServiceID: "redis", BackendID: "redis-dashboard"}))
+		})
+
+		It("doesn't map unknown dashboard client IDs", func() {
+			Ω(lookup("postgres-dashboard-space1").Code).Should(Equal(404))
+		})
+
+		It("only looks up dashboard client IDs with the lookup credentials", func() {
+			Ω(makeRequest("GET", "/dashboard_clients/redis-dashboard-space1").Code).Should(Equal(401))
+			Ω(makeRequestAs("dashboard", "lookup-secret", "GET", "/metrics").Code).Should(Equal(401))
+		})
+
+		Context("when the backend broker has credentials", func() {
+			BeforeEach(func() {
+				config.Backends[0].Username = "backend"
+				config.Backends[0].Password = "backend-secret"
+				backend.RouteToHandler("GET", "/v2/catalog", ghttp.CombineHandlers(
+					ghttp.VerifyBasicAuth("backend", "backend-secret"),
+					ghttp.RespondWith(200, `{"services":[{"id":"redis","name":"redis","dashboard_client":{"id":"redis-dashboard"},"plans":[]}]}`),
+				))
+			})
+
+			It("fetches the catalog with them", func() {
+				Ω(lookup("redis-dashboard-space1").Code).Should(Equal(200))
+			})
+		})
+
+		Context("when the backend broker needs the platform's credentials", func() {
+			BeforeEach(func() {
+				backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(401, `{}`))
+			})
+
+			It("says the backend broker needs credentials in the config", func() {
+				response := lookup("redis-dashboard-space1")
+
+				Ω(response.Code).Should(Equal(502))
+				Ω(response.Body.String()).Should(ContainSubstring("lookups need its username and password in buddy's config"))
+			})
+		})
+
+		It("tells the backend broker the suffix", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("X-Buddy-Suffix", "space1"),
+				ghttp.RespondWith(201, `{"dashboard_url":"https://dashboard.example.com/instance1"}`),
+			))
+
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1").Code).Should(Equal(201))
+		})
+	})
+
+	Describe("Test drop", func() {
+		BeforeEach(func() {
+			config.DashboardClients = "drop"
+		})
+
+		It("removes dashboard clients", func() {
+			Ω(dashboardClient("space1")).Should(BeNil())
+		})
+	})
+
+	Describe("Test config", func() {
+		It("rejects unknown modes", func() {
+			config.DashboardClients = "rename"
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring(`dashboard_clients must be keep, suffix or drop, not "rename"`)))
+		})
+
+		It("rejects a dashboard lookup without credentials or suffixed client IDs", func() {
+			config.DashboardLookup = &DashboardLookupConfig{Username: "dashboard"}
+
+			err := config.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("dashboard_lookup: username and password are required")))
+			Ω(err).Should(MatchError(ContainSubstring("dashboard_lookup: needs dashboard_clients: suffix")))
+		})
+	})
+})
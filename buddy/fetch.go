@@ -0,0 +1,79 @@
+package buddy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// instanceResponse is the answer to fetching a service instance buddy
+// builds from its registry
+type instanceResponse struct {
+	ServiceID string `json:"service_id"`
+	PlanID    string `json:"plan_id"`
+}
+
+// fetchFromRegistry routes fetch requests by the service and plan buddy
+// recorded for the instance or binding, and answers them from the record when
+// the backend broker's catalog doesn't declare them retrievable
+var fetchFromRegistry = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	b := call.handler
+	if b.Registry == nil {
+		return nil
+	}
+	record, found, err := b.Registry.Find(call.InstanceID, call.BindingID)
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": call.InstanceID, "binding_id": call.BindingID})
+		return rejectf(http.StatusInternalServerError, "%s", err)
+	}
+	if !found || record.Suffix != call.Suffix {
+		return nil
+	}
+	call.details = requestDetails{ServiceID: record.ServiceID, PlanID: record.PlanID}
+	if b.retrievable(record, req.Header) {
+		return nil
+	}
+
+	b.Logger.Info("fetch-from-registry", lager.Data{"suffix": call.Suffix, "instance_id": call.InstanceID, "binding_id": call.BindingID})
+	if record.BindingID != "" {
+		// buddy never keeps credentials, so there is nothing to tell
+		return rejection{status: http.StatusOK, response: struct{}{}}
+	}
+	return rejection{status: http.StatusOK, response: instanceResponse{
+		ServiceID: b.IDs.SuffixID(record.Suffix, record.ServiceID),
+		PlanID:    b.IDs.SuffixID(record.Suffix, record.PlanID),
+	}}
+})
+
+// retrievable tells whether the catalog of the backend broker holding a
+// record declares its instances, or its bindings, retrievable. Backend
+// brokers whose API version can't fetch them aren't asked. When the catalog
+// can't tell, the backend broker is asked anyway.
+func (b AppHandler) retrievable(record Record, header http.Header) bool {
+	field := "instances_retrievable"
+	if record.BindingID != "" {
+		field = "bindings_retrievable"
+	}
+	for _, backend := range b.backendBrokersFor(record.Suffix) {
+		if backend.label() != record.Backend {
+			continue
+		}
+		if backend.APIVersion.olderThan(retrievableVersion) {
+			return false
+		}
+		result := b.fetchCatalog(backend, header)
+		if result.Err != nil {
+			return true
+		}
+		for _, service := range result.Catalog.Services {
+			if service.Fields.stringField("id") == record.ServiceID {
+				var retrievable bool
+				json.Unmarshal(service.Fields[field], &retrievable)
+				return retrievable
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package buddy_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Fetch", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		catalog   string
+	)
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	JustBeforeEach(func() {
+		backend = ghttp.NewServer()
+		backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200, catalog))
+		os.Setenv("BACKEND_BROKER", backend.URL())
+		brokerAPI = New(lager.NewLogger("buddy-fetch-tests"))
+
+		backend.AppendHandlers(
+			ghttp.RespondWith(201, "{}"),
+			ghttp.RespondWith(201, `{"credentials":{"password":"secret"}}`),
+		)
+		Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`).Code).Should(Equal(201))
+		Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1", `{"service_id":"redis-space1","plan_id":"small-space1"}`).Code).Should(Equal(201))
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	Context("when the backend broker can fetch instances and bindings", func() {
+		BeforeEach(func() {
+			catalog = `{"services":[{"id":"redis","name":"redis","instances_retrievable":true,"bindings_retrievable":true,"plans":[{"id":"small","name":"small"}]}]}`
+		})
+
+		It("proxies fetching an instance and suffixes its IDs", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/service_instances/instance1", "service_id=redis"),
+				ghttp.RespondWith(200, `{"service_id":"redis","plan_id":"small","dashboard_url":"https://dashboard"}`),
+			))
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1?service_id=redis-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"service_id":"redis-space1","plan_id":"small-space1","dashboard_url":"https://dashboard"}`))
+		})
+
+		It("proxies fetching a binding", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/v2/service_instances/instance1/service_bindings/binding1"),
+				ghttp.RespondWith(200, `{"credentials":{"password":"secret"}}`),
+			))
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"credentials":{"password":"secret"}}`))
+		})
+
+		It("passes on errors of the backend broker", func() {
+			backend.AppendHandlers(ghttp.RespondWith(404, `{"description":"gone"}`))
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(response.Body).Should(MatchJSON(`{"description":"gone"}`))
+		})
+	})
+
+	Context("when the backend broker can't fetch instances and bindings", func() {
+		BeforeEach(func() {
+			catalog = `{"services":[{"id":"redis","name":"redis","plans":[{"id":"small","name":"small"}]}]}`
+		})
+
+		It("answers fetching an instance from the registry", func() {
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("answers fetching a binding from the registry", func() {
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{}`))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("doesn't answer for instances of other suffixes", func() {
+			response := makeRequest("GET", "/space2/v2/service_instances/instance1", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+})
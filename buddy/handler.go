@@ -1,15 +1,12 @@
 package buddy
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pivotal-cf/brokerapi"
 	"github.com/pivotal-golang/lager"
 )
 
@@ -17,8 +14,35 @@ var statusUnprocessableEntity = 422
 
 // AppHandler is the main app
 type AppHandler struct {
-	BackendBroker backendBroker
-	Logger        lager.Logger
+	BackendBroker   backendBroker
+	BackendBrokers  map[string]backendBroker
+	SuffixRules     []SuffixRule
+	Auth            *AuthConfig
+	Credentials     CredentialStore
+	Admin           *AdminConfig
+	MetricsAuth     *MetricsConfig
+	DashboardLookup *DashboardLookupConfig
+	Registry        Registry
+	StrictIsolation bool
+	Metrics         *Metrics
+	Tracer          *Tracer
+	// Client is shared by all backend calls, so they share a connection pool
+	Client            *http.Client
+	OperationTimeouts map[string]time.Duration
+	Retries           RetryConfig
+	breakers          map[string]*circuitBreaker
+	// OrphanMitigation deletes what backend brokers may have created when
+	// they failed a provision or bind, nil when disabled
+	OrphanMitigation *OrphanMitigationConfig
+	orphans          *orphanLog
+	// IDs gives every suffix its own service and plan IDs
+	IDs       IDStrategy
+	learntIDs *learntSuffixes
+	// DashboardClientMode keeps, suffixes or drops the dashboard clients of
+	// the catalogs
+	DashboardClientMode string
+	asyncOperations     *asyncOperationLog
+	Logger              lager.Logger
 }
 
 type errorResponse struct {
@@ -26,293 +50,133 @@ type errorResponse struct {
 	Description string `json:"description"`
 }
 
+// catalog merges the catalogs of all backend brokers of a suffix, so unlike
+// the other endpoints it is no ReverseProxy
 func (b AppHandler) catalog(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	suffix := "-" + vars["suffix"]
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/catalog", b.BackendBroker.URL)
-	backendReq, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		b.Logger.Error("backend-catalog-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-
-	resp, err := client.Do(backendReq)
-	if err != nil {
-		b.Logger.Error("backend-catalog-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusUnauthorized {
-		b.respond(w, http.StatusUnauthorized, errorResponse{
-			Description: "Not authorized",
-		})
-	}
-
-	jsonData, err := ioutil.ReadAll(resp.Body)
-	b.Logger.Info(string(jsonData))
-	b.Logger.Info(b.BackendBroker.URL)
-	var catalog brokerapi.CatalogResponse
-	err = json.Unmarshal(jsonData, &catalog)
-	if err != nil {
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
+	backends := b.backendBrokersFor(vars["suffix"])
+	if len(backends) == 0 {
+		b.respondError(w, "backend-broker-lookup", b.noBackendBroker(vars["suffix"]))
 		return
 	}
-	for i, service := range catalog.Services {
-		catalog.Services[i].ID = service.ID + suffix
-		catalog.Services[i].Name = service.Name + suffix
-		for j, plan := range service.Plans {
-			catalog.Services[i].Plans[j].ID = plan.ID + suffix
+	results := b.fetchCatalogs(backends, req.Header)
+	for i, result := range results {
+		if result.BackendStatus == 0 && result.Err != nil {
+			b.observeBackendError(w, backends[i], result.Err)
+			continue
+		}
+		b.observeBackend(w, backends[i], result.BackendStatus)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			b.respond(w, result.Status, errorResponse{
+				Description: result.Err.Error(),
+			})
+			return
 		}
 	}
-	b.respond(w, http.StatusOK, catalog)
-}
-
-func (b AppHandler) provision(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	suffix := "-" + vars["suffix"]
-	instanceID := vars["instance_id"]
-
-	var details struct {
-		ServiceID        string      `json:"service_id"`
-		PlanID           string      `json:"plan_id"`
-		OrganizationGUID string      `json:"organization_guid"`
-		SpaceGUID        string      `json:"space_guid"`
-		Parameters       interface{} `json:"parameters,omitempty"`
-	}
-
-	if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
-		b.respond(w, statusUnprocessableEntity, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-
-	fmt.Printf("provision: decoded details: %#v\n", details)
-
-	details.ServiceID = strings.TrimSuffix(details.ServiceID, suffix)
-	details.PlanID = strings.TrimSuffix(details.PlanID, suffix)
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s", b.BackendBroker.URL, instanceID)
-	buffer := &bytes.Buffer{}
-	if err := json.NewEncoder(buffer).Encode(details); err != nil {
-		b.Logger.Error("backend-provision-encode-details", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-
-	fmt.Println("provision: encoded details:", buffer.String())
-
-	backendReq, err := http.NewRequest("PUT", url, buffer)
+	catalog, err := b.mergeCatalogs(backends, results, vars["suffix"], platformVersion(req.Header))
 	if err != nil {
-		b.Logger.Error("backend-provision-req", err)
+		b.Logger.Error("backend-catalog-merge", err)
 		b.respond(w, http.StatusInternalServerError, errorResponse{
 			Description: err.Error(),
 		})
 		return
 	}
-	backendReq.Header = req.Header
-
-	httpResp, err := client.Do(backendReq)
+	data, err := marshalJSON(catalog)
 	if err != nil {
-		b.Logger.Error("backend-provision-resp", err)
+		b.Logger.Error("backend-catalog-encode", err)
 		b.respond(w, http.StatusInternalServerError, errorResponse{
 			Description: err.Error(),
 		})
 		return
 	}
-	defer httpResp.Body.Close()
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
-func (b AppHandler) deprovision(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceID := vars["instance_id"]
-
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s?plan_id=%s&service_id=%s", b.BackendBroker.URL, instanceID, req.FormValue("plan_id"), req.FormValue("service_id"))
-	buffer := &bytes.Buffer{}
-
-	backendReq, err := http.NewRequest("DELETE", url, buffer)
-	if err != nil {
-		b.Logger.Error("backend-deprovision-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-
-	httpResp, err := client.Do(backendReq)
-	if err != nil {
-		b.Logger.Error("backend-deprovision-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	defer httpResp.Body.Close()
-
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
-	w.Write(data)
+// provisionProxy creates service instances
+var provisionProxy = ReverseProxy{
+	Operation:         "provision",
+	RequestRewriters:  []RequestRewriter{instanceIDFree, unsuffixRequestBody, unsuffixRequestQuery, logProvisionDetails},
+	ResponseRewriters: []ResponseRewriter{recordProvisioned, suffixResponseBody, downgradeResponse},
+	MitigateOrphans:   true,
 }
 
-func (b AppHandler) lastOperation(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceID := vars["instance_id"]
-
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s/last_operation", b.BackendBroker.URL, instanceID)
-	buffer := &bytes.Buffer{}
-
-	backendReq, err := http.NewRequest("GET", url, buffer)
-	if err != nil {
-		b.Logger.Error("backend-lastoperations-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-	backendReq.Body = req.Body
-
-	httpResp, err := client.Do(backendReq)
-	if err != nil {
-		b.Logger.Error("backend-lastoperations-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	defer httpResp.Body.Close()
-
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
-	w.Write(data)
+// deprovisionProxy deletes service instances
+var deprovisionProxy = ReverseProxy{
+	Operation:         "deprovision",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{forgetDeleted},
 }
 
-func (b AppHandler) update(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceID := vars["instance_id"]
-
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s", b.BackendBroker.URL, instanceID)
-	buffer := &bytes.Buffer{}
-
-	backendReq, err := http.NewRequest("PATCH", url, buffer)
-	if err != nil {
-		b.Logger.Error("backend-update-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-	backendReq.Body = req.Body
-
-	httpResp, err := client.Do(backendReq)
-	if err != nil {
-		b.Logger.Error("backend-update-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	defer httpResp.Body.Close()
-
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
-	w.Write(data)
+// lastOperationProxy polls asynchronous operations on service instances
+var lastOperationProxy = ReverseProxy{
+	Operation:         "last_operation",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{forgetPolledDeprovision, downgradeResponse},
 }
 
-func (b AppHandler) bind(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceID := vars["instance_id"]
-	bindID := vars["binding_id"]
-
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s/service_bindings/%s", b.BackendBroker.URL, instanceID, bindID)
-	buffer := &bytes.Buffer{}
-	backendReq, err := http.NewRequest("PUT", url, buffer)
-	if err != nil {
-		b.Logger.Error("backend-binding-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-	backendReq.Body = req.Body
+// updateProxy changes service instances
+var updateProxy = ReverseProxy{
+	Operation:         "update",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestBody, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{recordUpdated, suffixResponseBody, downgradeResponse},
+}
 
-	httpResp, err := client.Do(backendReq)
-	if err != nil {
-		b.Logger.Error("backend-binding-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	defer httpResp.Body.Close()
+// bindProxy creates service bindings
+var bindProxy = ReverseProxy{
+	Operation:         "bind",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestBody, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{recordBound, downgradeResponse},
+	MitigateOrphans:   true,
+	EmulateAsync:      true,
+}
 
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
-	w.Write(data)
-	return
+// unbindProxy deletes service bindings
+var unbindProxy = ReverseProxy{
+	Operation:         "unbind",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{forgetDeleted},
+	EmulateAsync:      true,
 }
 
-func (b AppHandler) unbind(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceID := vars["instance_id"]
-	bindingID := vars["binding_id"]
+// bindingLastOperationProxy polls asynchronous operations on service bindings
+var bindingLastOperationProxy = ReverseProxy{
+	Operation:         "binding_last_operation",
+	RequestRewriters:  []RequestRewriter{ownsInstance, emulatedLastOperation, unsuffixRequestQuery},
+	ResponseRewriters: []ResponseRewriter{forgetPolledDeprovision},
+}
 
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/v2/service_instances/%s/service_bindings/%s?plan_id=%s&service_id=%s", b.BackendBroker.URL, instanceID, bindingID, req.FormValue("plan_id"), req.FormValue("service_id"))
-	buffer := &bytes.Buffer{}
+// fetchInstanceProxy reads service instances
+var fetchInstanceProxy = ReverseProxy{
+	Operation:         "fetch_instance",
+	RequestRewriters:  []RequestRewriter{ownsInstance, unsuffixRequestQuery, fetchFromRegistry},
+	ResponseRewriters: []ResponseRewriter{suffixResponseBody, downgradeResponse},
+}
 
-	backendReq, err := http.NewRequest("DELETE", url, buffer)
-	if err != nil {
-		b.Logger.Error("backend-unbinding-req", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
-	}
-	backendReq.Header = req.Header
-	backendReq.Body = req.Body
+// fetchBindingProxy reads service bindings
+var fetchBindingProxy = ReverseProxy{
+	Operation:         "fetch_binding",
+	RequestRewriters:  []RequestRewriter{ownsInstance, fetchEmulatedBinding, unsuffixRequestQuery, fetchFromRegistry},
+	ResponseRewriters: []ResponseRewriter{suffixResponseBody, downgradeResponse},
+}
 
-	httpResp, err := client.Do(backendReq)
+// logProvisionDetails logs provision requests at debug level
+var logProvisionDetails = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	body, err := requestBody(req)
 	if err != nil {
-		b.Logger.Error("backend-unbinding-resp", err)
-		b.respond(w, http.StatusInternalServerError, errorResponse{
-			Description: err.Error(),
-		})
-		return
+		return err
 	}
-	defer httpResp.Body.Close()
+	call.handler.Logger.Debug("provision-details", lager.Data{"suffix": call.Suffix, "instance_id": call.InstanceID, "details": json.RawMessage(body)})
+	return nil
+})
 
-	var data []byte
-	data, err = ioutil.ReadAll(httpResp.Body)
-	w.WriteHeader(httpResp.StatusCode)
-	w.Write(data)
+// noBackendBroker rejects a suffix that no backend broker serves
+func (b AppHandler) noBackendBroker(suffix string) error {
+	b.Logger.Error("backend-broker-lookup", fmt.Errorf("No backend broker for suffix %s", suffix))
+	return rejectf(http.StatusNotFound, "No backend broker configured for suffix %s", suffix)
 }
 
 func (b AppHandler) reject(w http.ResponseWriter, r *http.Request) {
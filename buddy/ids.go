@@ -0,0 +1,162 @@
+package buddy
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	suffixIDStrategy = "suffix"
+	uuidIDStrategy   = "uuid"
+)
+
+// uuidNamespace is the URL namespace of RFC 4122; buddy's UUIDs name
+// buddy-broker://<suffix>/<backend ID>
+var uuidNamespace = []byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// IDStrategy gives every suffix its own service and plan IDs, derived from
+// the IDs of the backend brokers
+type IDStrategy interface {
+	// SuffixID is the ID a suffix offers for a backend service or plan ID
+	SuffixID(suffix, backendID string) string
+	// BackendID translates an ID a suffix offers back, false when the
+	// strategy does not know it
+	BackendID(suffix, id string) (string, bool)
+}
+
+// newIDStrategy returns the strategy of a config value; empty means suffix
+func newIDStrategy(name string) (IDStrategy, error) {
+	switch name {
+	case "", suffixIDStrategy:
+		return suffixIDs{}, nil
+	case uuidIDStrategy:
+		return newUUIDIDs(), nil
+	}
+	return nil, fmt.Errorf("id_strategy must be %s or %s, not %q", suffixIDStrategy, uuidIDStrategy, name)
+}
+
+// suffixIDs appends "-<suffix>" to the backend IDs
+type suffixIDs struct{}
+
+func (suffixIDs) SuffixID(suffix, backendID string) string {
+	return backendID + "-" + suffix
+}
+
+// BackendID strips the suffix; IDs without it are passed on as they are
+func (suffixIDs) BackendID(suffix, id string) (string, bool) {
+	return strings.TrimSuffix(id, "-"+suffix), true
+}
+
+// uuidIDs derives a version 5 UUID from the suffix and the backend ID, and
+// remembers every UUID it handed out to translate it back
+type uuidIDs struct {
+	mutex      sync.RWMutex
+	backendIDs map[uuidKey]string
+}
+
+type uuidKey struct {
+	suffix string
+	id     string
+}
+
+func newUUIDIDs() *uuidIDs {
+	return &uuidIDs{backendIDs: map[uuidKey]string{}}
+}
+
+func (s *uuidIDs) SuffixID(suffix, backendID string) string {
+	id := uuidV5(uuidNamespace, "buddy-broker://"+suffix+"/"+backendID)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.backendIDs[uuidKey{suffix, id}] = backendID
+	return id
+}
+
+func (s *uuidIDs) BackendID(suffix, id string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	backendID, ok := s.backendIDs[uuidKey{suffix, id}]
+	return backendID, ok
+}
+
+// uuidV5 is the name based UUID of RFC 4122 using SHA-1
+func uuidV5(namespace []byte, name string) string {
+	hash := sha1.New()
+	hash.Write(namespace)
+	hash.Write([]byte(name))
+	data := hash.Sum(nil)[:16]
+	data[6] = (data[6] & 0x0f) | 0x50
+	data[8] = (data[8] & 0x3f) | 0x80
+	return formatUUID(data)
+}
+
+// learntSuffixes are the suffixes whose IDs were learnt from the catalogs of
+// all their backend brokers since buddy started
+type learntSuffixes struct {
+	mutex    sync.RWMutex
+	suffixes map[string]bool
+}
+
+func newLearntSuffixes() *learntSuffixes {
+	return &learntSuffixes{suffixes: map[string]bool{}}
+}
+
+func (l *learntSuffixes) has(suffix string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.suffixes[suffix]
+}
+
+func (l *learntSuffixes) add(suffix string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.suffixes[suffix] = true
+}
+
+// backendID translates a service or plan ID of a suffix back. IDs the
+// strategy doesn't know, e.g. after a restart, are learnt from the catalogs
+// of the suffix's backend brokers, once per suffix; IDs no catalog offers are
+// passed on as they are. Catalogs served later hand out their IDs anyway.
+func (b AppHandler) backendID(suffix, id string, header http.Header) string {
+	if id == "" {
+		return id
+	}
+	if backendID, ok := b.IDs.BackendID(suffix, id); ok {
+		return backendID
+	}
+	if b.learntIDs.has(suffix) {
+		return id
+	}
+	if b.learnIDs(suffix, header) {
+		b.learntIDs.add(suffix)
+	}
+	if backendID, ok := b.IDs.BackendID(suffix, id); ok {
+		return backendID
+	}
+	return id
+}
+
+// learnIDs hands out the IDs of every service and plan a suffix offers,
+// telling whether every catalog could be fetched
+func (b AppHandler) learnIDs(suffix string, header http.Header) bool {
+	backends := b.backendBrokersFor(suffix)
+	learnt := true
+	for i, result := range b.fetchCatalogs(backends, header) {
+		if result.Err != nil {
+			b.Logger.Error("learn-ids", result.Err, lager.Data{"suffix": suffix, "backend": backends[i].label()})
+			learnt = false
+			continue
+		}
+		for _, service := range result.Catalog.Services {
+			b.IDs.SuffixID(suffix, service.Fields.stringField("id"))
+			for _, plan := range service.Plans {
+				b.IDs.SuffixID(suffix, plan.stringField("id"))
+			}
+		}
+	}
+	return learnt
+}
@@ -0,0 +1,141 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("ID strategy", func() {
+	var (
+		backend *ghttp.Server
+		config  Config
+	)
+
+	redisCatalog := `{"services":[{"id":"redis","name":"redis","plans":[{"id":"redis-small","name":"small"}]}]}`
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200, redisCatalog))
+		config = Config{
+			Backends:   []BackendConfig{{Name: "redis", URL: backend.URL()}},
+			IDStrategy: "uuid",
+		}
+		Ω(config.Validate()).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(brokerAPI http.Handler, method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json")
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	catalog := func(brokerAPI http.Handler, suffix string) brokerapi.CatalogResponse {
+		response := makeRequest(brokerAPI, "GET", "/"+suffix+"/v2/catalog", "")
+		Ω(response.Code).Should(Equal(200))
+		var catalog brokerapi.CatalogResponse
+		Ω(json.Unmarshal(response.Body.Bytes(), &catalog)).Should(Succeed())
+		return catalog
+	}
+
+	Describe("Test UUIDs", func() {
+		It("offers UUIDs as service and plan IDs", func() {
+			brokerAPI := NewWithConfig(lager.NewLogger("buddy-ids-tests"), config)
+
+			service := catalog(brokerAPI, "space1").Services[0]
+
+			Ω(service.ID).Should(MatchRegexp(uuidPattern.String()))
+			Ω(service.Plans[0].ID).Should(MatchRegexp(uuidPattern.String()))
+			Ω(service.Name).Should(Equal("redis-space1"))
+		})
+
+		It("derives the same UUIDs every time and different ones per suffix", func() {
+			space1 := catalog(NewWithConfig(lager.NewLogger("buddy-ids-tests"), config), "space1").Services[0]
+			again := catalog(NewWithConfig(lager.NewLogger("buddy-ids-tests"), config), "space1").Services[0]
+			space2 := catalog(NewWithConfig(lager.NewLogger("buddy-ids-tests"), config), "space2").Services[0]
+
+			Ω(again.ID).Should(Equal(space1.ID))
+			Ω(again.Plans[0].ID).Should(Equal(space1.Plans[0].ID))
+			Ω(space2.ID).ShouldNot(Equal(space1.ID))
+		})
+
+		It("translates the UUIDs back for the backend broker", func() {
+			brokerAPI := NewWithConfig(lager.NewLogger("buddy-ids-tests"), config)
+			service := catalog(brokerAPI, "space1").Services[0]
+			backend.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1"),
+					ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"redis-small"}`),
+					ghttp.RespondWith(201, "{}"),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1", "plan_id=redis-small&service_id=redis"),
+					ghttp.RespondWith(200, "{}"),
+				),
+			)
+
+			provision := makeRequest(brokerAPI, "PUT", "/space1/v2/service_instances/instance1",
+				`{"service_id":"`+service.ID+`","plan_id":"`+service.Plans[0].ID+`"}`)
+			deprovision := makeRequest(brokerAPI, "DELETE",
+				"/space1/v2/service_instances/instance1?service_id="+service.ID+"&plan_id="+service.Plans[0].ID, "")
+
+			Ω(provision.Code).Should(Equal(201))
+			Ω(deprovision.Code).Should(Equal(200))
+		})
+
+		It("learns UUIDs it has not handed out from the backend catalog", func() {
+			service := catalog(NewWithConfig(lager.NewLogger("buddy-ids-tests"), config), "space1").Services[0]
+			restarted := NewWithConfig(lager.NewLogger("buddy-ids-tests"), config)
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"redis-small"}`),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest(restarted, "PUT", "/space1/v2/service_instances/instance1",
+				`{"service_id":"`+service.ID+`","plan_id":"`+service.Plans[0].ID+`"}`)
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("learns the UUIDs of a suffix only once", func() {
+			brokerAPI := NewWithConfig(lager.NewLogger("buddy-ids-tests"), config)
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"), ghttp.RespondWith(201, "{}"))
+
+			makeRequest(brokerAPI, "PUT", "/space1/v2/service_instances/instance1", `{"service_id":"unknown","plan_id":"unknown"}`)
+			makeRequest(brokerAPI, "PUT", "/space1/v2/service_instances/instance2", `{"service_id":"unknown","plan_id":"unknown"}`)
+
+			catalogRequests := 0
+			for _, req := range backend.ReceivedRequests() {
+				if req.URL.Path == "/v2/catalog" {
+					catalogRequests++
+				}
+			}
+			Ω(catalogRequests).Should(Equal(1))
+		})
+	})
+
+	Describe("Test config", func() {
+		It("rejects unknown strategies", func() {
+			config.IDStrategy = "guid"
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring(`id_strategy must be suffix or uuid, not "guid"`)))
+		})
+	})
+})
@@ -0,0 +1,51 @@
+package buddy
+
+import (
+	"net/http"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// ownsInstance checks the instance was provisioned through the suffix before
+// letting a request touch it, rejecting it with 404 if it was not. Instances
+// buddy has no record of are rejected too when StrictIsolation is on.
+// Instances of other suffixes get the same answer as unknown ones, so a space
+// can't probe for them. Deletes are never answered with 410: the platform
+// would take that for done and leak whatever the backend still holds.
+var ownsInstance = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	b := call.handler
+	if b.Registry == nil {
+		return nil
+	}
+	record, found, err := b.Registry.Find(call.InstanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": call.InstanceID})
+		return rejectf(http.StatusInternalServerError, "%s", err)
+	}
+	if (found && record.Suffix == call.Suffix) || (!found && !b.StrictIsolation) {
+		return nil
+	}
+
+	b.Logger.Info("isolation-rejected", lager.Data{"suffix": call.Suffix, "instance_id": call.InstanceID})
+	return rejectf(http.StatusNotFound, "Service instance %s not found", call.InstanceID)
+})
+
+// instanceIDFree checks no other suffix has provisioned the instance ID,
+// rejecting the request with a conflict if one has
+var instanceIDFree = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	b := call.handler
+	if b.Registry == nil {
+		return nil
+	}
+	record, found, err := b.Registry.Find(call.InstanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": call.InstanceID})
+		return rejectf(http.StatusInternalServerError, "%s", err)
+	}
+	if !found || record.Suffix == call.Suffix {
+		return nil
+	}
+
+	b.Logger.Info("isolation-rejected", lager.Data{"suffix": call.Suffix, "instance_id": call.InstanceID})
+	return rejectf(http.StatusConflict, "Service instance %s already exists", call.InstanceID)
+})
@@ -0,0 +1,152 @@
+package buddy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Isolation", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		tmpDir    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-isolation")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend = ghttp.NewServer()
+		os.Setenv("BACKEND_BROKER", backend.URL())
+		os.Setenv("REGISTRY_FILE", filepath.Join(tmpDir, "registry.json"))
+		brokerAPI = New(lager.NewLogger("buddy-isolation-tests"))
+
+		backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("PUT", "/space1/v2/service_instances/instance1",
+			bytes.NewBufferString(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+		brokerAPI.ServeHTTP(recorder, request)
+		Ω(recorder.Code).Should(Equal(201))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("STRICT_ISOLATION")
+		os.Unsetenv("REGISTRY_FILE")
+		os.RemoveAll(tmpDir)
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test other suffixes", func() {
+		It("can't deprovision the instance", func() {
+			response := makeRequest("DELETE", "/space2/v2/service_instances/instance1?service_id=redis-space2&plan_id=small-space2", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("can't update the instance", func() {
+			response := makeRequest("PATCH", "/space2/v2/service_instances/instance1", `{"service_id":"redis-space2","plan_id":"large-space2"}`)
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("can't bind the instance", func() {
+			response := makeRequest("PUT", "/space2/v2/service_instances/instance1/service_bindings/binding1", `{"service_id":"redis-space2","plan_id":"small-space2"}`)
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("can't unbind the instance", func() {
+			response := makeRequest("DELETE", "/space2/v2/service_instances/instance1/service_bindings/binding1?service_id=redis-space2&plan_id=small-space2", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("can't poll the instance", func() {
+			response := makeRequest("GET", "/space2/v2/service_instances/instance1/last_operation", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("can't provision the same instance ID", func() {
+			response := makeRequest("PUT", "/space2/v2/service_instances/instance1", `{"service_id":"redis-space2","plan_id":"small-space2"}`)
+
+			Ω(response.Code).Should(Equal(409))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Test own suffix", func() {
+		It("deprovisions the instance", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, "{}"))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("rejects unknown instances", func() {
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance2?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(404))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("passes unknown instances through without a registry file", func() {
+			os.Unsetenv("REGISTRY_FILE")
+			brokerAPI = New(lager.NewLogger("buddy-isolation-tests"))
+			backend.AppendHandlers(ghttp.RespondWith(200, "{}"))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance2?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("passes unknown instances through without strict isolation", func() {
+			os.Setenv("STRICT_ISOLATION", "false")
+			brokerAPI = New(lager.NewLogger("buddy-isolation-tests"))
+			backend.AppendHandlers(ghttp.RespondWith(410, "{}"))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance2?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(410))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("doesn't claim unknown instances on update", func() {
+			os.Setenv("STRICT_ISOLATION", "false")
+			brokerAPI = New(lager.NewLogger("buddy-isolation-tests"))
+			backend.AppendHandlers(ghttp.RespondWith(200, "{}"), ghttp.RespondWith(200, "{}"))
+			Ω(makeRequest("PATCH", "/space2/v2/service_instances/instance2", `{"service_id":"redis-space2","plan_id":"large-space2"}`).Code).Should(Equal(200))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance2?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(3))
+		})
+	})
+})
@@ -0,0 +1,298 @@
+package buddy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request duration
+// histogram, the Prometheus client defaults plus the slow end of OSB calls
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// unauthenticatedSuffix labels requests whose credentials were rejected, and
+// those of suffixes buddy doesn't know. Anyone can make up suffixes, so only
+// suffixes with registry records or a successful backend response become
+// series of their own.
+const unauthenticatedSuffix = ""
+
+// Metrics counts the OSB requests buddy handles and exports them in the
+// Prometheus text format
+type Metrics struct {
+	mutex         sync.Mutex
+	requests      map[requestLabels]*histogram
+	backendErrors map[requestLabels]uint64
+}
+
+// requestLabels identify a series; status is the HTTP status code, or
+// "error" when the backend broker could not be reached
+type requestLabels struct {
+	operation string
+	suffix    string
+	backend   string
+	status    string
+}
+
+func (l requestLabels) String() string {
+	return fmt.Sprintf(`operation="%s",suffix="%s",backend="%s",status="%s"`,
+		escapeLabel(l.operation), escapeLabel(l.suffix), escapeLabel(l.backend), escapeLabel(l.status))
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:      map[requestLabels]*histogram{},
+		backendErrors: map[requestLabels]uint64{},
+	}
+}
+
+func (m *Metrics) observeRequest(labels requestLabels, seconds float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.requests[labels] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *Metrics) countBackendError(labels requestLabels) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.backendErrors[labels]++
+}
+
+// instrumentedWriter remembers the status of a response and the backend
+// brokers that were called to build it
+type instrumentedWriter struct {
+	http.ResponseWriter
+	operation   string
+	suffix      string
+	status      int
+	wroteHeader bool
+	backends    []string
+	// backendSucceeded is set once a backend broker answered with 2xx
+	backendSucceeded bool
+	// backendErrors are counted once the suffix label is known
+	backendErrors []requestLabels
+}
+
+func (w *instrumentedWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *instrumentedWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush sends what was written so far, so proxied responses stream
+func (w *instrumentedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// observeBackend labels the response with a backend broker that answered
+// with status, 0 when it could not be reached, and counts it as a backend
+// error when it failed
+func (b AppHandler) observeBackend(w http.ResponseWriter, backend backendBroker, status int) {
+	iw, ok := w.(*instrumentedWriter)
+	if !ok {
+		return
+	}
+	iw.backends = append(iw.backends, backend.label())
+	if status >= 200 && status < 300 {
+		iw.backendSucceeded = true
+	}
+	if status != 0 && status < 500 {
+		return
+	}
+	labels := requestLabels{operation: iw.operation, backend: backend.label(), status: "error"}
+	if status != 0 {
+		labels.status = strconv.Itoa(status)
+	}
+	iw.backendErrors = append(iw.backendErrors, labels)
+}
+
+// observeBackendError labels the response with a backend broker that failed
+// with err, counting the failure; open circuits are counted apart
+func (b AppHandler) observeBackendError(w http.ResponseWriter, backend backendBroker, err error) {
+	if _, ok := err.(circuitOpenError); !ok {
+		b.observeBackend(w, backend, 0)
+		return
+	}
+	iw, ok := w.(*instrumentedWriter)
+	if !ok {
+		return
+	}
+	iw.backends = append(iw.backends, backend.label())
+	iw.backendErrors = append(iw.backendErrors, requestLabels{operation: iw.operation, backend: backend.label(), status: "circuit_open"})
+}
+
+// suffixLabel is the suffix a request is counted under
+func (b AppHandler) suffixLabel(iw *instrumentedWriter, authenticated bool) string {
+	if !authenticated || iw.status == http.StatusUnauthorized {
+		return unauthenticatedSuffix
+	}
+	if iw.backendSucceeded || b.hasRecords(iw.suffix) {
+		return iw.suffix
+	}
+	return unauthenticatedSuffix
+}
+
+// hasRecords tells whether the registry holds instances of the suffix
+func (b AppHandler) hasRecords(suffix string) bool {
+	if b.Registry == nil {
+		return false
+	}
+	records, err := b.Registry.List()
+	if err != nil {
+		b.Logger.Error("metrics-registry-list", err)
+		return false
+	}
+	for _, record := range records {
+		if record.Suffix == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// metrics exports the request metrics and the registry gauges
+func (b AppHandler) metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	b.Metrics.write(w)
+	if b.Registry != nil {
+		records, err := b.Registry.List()
+		if err != nil {
+			b.Logger.Error("metrics-registry-list", err)
+			return
+		}
+		writeRegistryGauges(w, records)
+	}
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sortLabels(requests)
+
+	fmt.Fprintln(w, "# HELP buddy_requests_total OSB requests handled by buddy.")
+	fmt.Fprintln(w, "# TYPE buddy_requests_total counter")
+	for _, labels := range requests {
+		fmt.Fprintf(w, "buddy_requests_total{%s} %d\n", labels, m.requests[labels].count)
+	}
+
+	fmt.Fprintln(w, "# HELP buddy_request_duration_seconds Time taken to handle OSB requests.")
+	fmt.Fprintln(w, "# TYPE buddy_request_duration_seconds histogram")
+	for _, labels := range requests {
+		h := m.requests[labels]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "buddy_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), h.buckets[i])
+		}
+		fmt.Fprintf(w, "buddy_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "buddy_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "buddy_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	backendErrors := make([]requestLabels, 0, len(m.backendErrors))
+	for labels := range m.backendErrors {
+		backendErrors = append(backendErrors, labels)
+	}
+	sortLabels(backendErrors)
+
+	fmt.Fprintln(w, "# HELP buddy_backend_errors_total Backend broker calls that failed or answered with a server error.")
+	fmt.Fprintln(w, "# TYPE buddy_backend_errors_total counter")
+	for _, labels := range backendErrors {
+		fmt.Fprintf(w, "buddy_backend_errors_total{%s} %d\n", labels, m.backendErrors[labels])
+	}
+}
+
+type registryLabels struct {
+	suffix  string
+	backend string
+}
+
+// writeRegistryGauges exports the number of instances, instances being
+// deprovisioned and bindings in the registry per suffix and backend
+func writeRegistryGauges(w io.Writer, records []Record) {
+	instances := map[registryLabels]int{}
+	deprovisioning := map[registryLabels]int{}
+	bindings := map[registryLabels]int{}
+	for _, record := range records {
+		labels := registryLabels{suffix: record.Suffix, backend: record.Backend}
+		switch {
+		case record.BindingID != "":
+			bindings[labels]++
+		case record.Deprovisioning:
+			instances[labels]++
+			deprovisioning[labels]++
+		default:
+			instances[labels]++
+		}
+	}
+	writeGauge(w, "buddy_registry_instances", "Service instances in the registry.", instances)
+	writeGauge(w, "buddy_registry_deprovisioning_instances", "Service instances in the registry being deprovisioned.", deprovisioning)
+	writeGauge(w, "buddy_registry_bindings", "Service bindings in the registry.", bindings)
+}
+
+func writeGauge(w io.Writer, name, help string, values map[registryLabels]int) {
+	series := make([]registryLabels, 0, len(values))
+	for labels := range values {
+		series = append(series, labels)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].suffix != series[j].suffix {
+			return series[i].suffix < series[j].suffix
+		}
+		return series[i].backend < series[j].backend
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	for _, labels := range series {
+		fmt.Fprintf(w, "%s{suffix=\"%s\",backend=\"%s\"} %d\n", name, escapeLabel(labels.suffix), escapeLabel(labels.backend), values[labels])
+	}
+}
+
+func sortLabels(labels []requestLabels) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].String() < labels[j].String()
+	})
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
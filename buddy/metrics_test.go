@@ -0,0 +1,175 @@
+package buddy_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		config = Config{
+			Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}},
+		}
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-metrics-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	scrape := func() string {
+		response := makeRequest("GET", "/metrics", "")
+		Ω(response.Code).Should(Equal(200))
+		Ω(response.Header().Get("Content-Type")).Should(HavePrefix("text/plain"))
+		return response.Body.String()
+	}
+
+	Describe("Test request metrics", func() {
+		It("counts requests by operation, suffix, backend and status", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(201, "{}"),
+			)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("PUT", "/space1/v2/service_instances/instance2", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`buddy_requests_total{operation="provision",suffix="space1",backend="redis",status="201"} 2`))
+			Ω(metrics).Should(ContainSubstring(`buddy_request_duration_seconds_bucket{operation="provision",suffix="space1",backend="redis",status="201",le="+Inf"} 2`))
+			Ω(metrics).Should(ContainSubstring(`buddy_request_duration_seconds_count{operation="provision",suffix="space1",backend="redis",status="201"} 2`))
+		})
+
+		It("counts requests rejected before reaching a backend", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance2", `not json`)
+
+			Ω(scrape()).Should(ContainSubstring(`buddy_requests_total{operation="provision",suffix="space1",backend="",status="422"} 1`))
+		})
+
+		It("counts requests of suffixes buddy doesn't know without their suffix", func() {
+			for _, suffix := range []string{"junk1", "junk2", "junk3"} {
+				makeRequest("PUT", "/"+suffix+"/v2/service_instances/instance1", `not json`)
+			}
+			backend.AppendHandlers(ghttp.RespondWith(500, "{}"))
+			makeRequest("GET", "/junk4/v2/catalog", "")
+
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`buddy_requests_total{operation="provision",suffix="",backend="",status="422"} 3`))
+			Ω(metrics).Should(ContainSubstring(`buddy_backend_errors_total{operation="catalog",suffix="",backend="redis",status="500"} 1`))
+			Ω(metrics).ShouldNot(ContainSubstring("junk"))
+		})
+
+		It("counts requests with rejected credentials without their suffix", func() {
+			config.Auth = &AuthConfig{Username: "buddy", Password: "buddy-secret"}
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-metrics-tests"), config)
+
+			Ω(makeRequest("GET", "/made-up-suffix/v2/catalog", "").Code).Should(Equal(401))
+
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`buddy_requests_total{operation="catalog",suffix="",backend="",status="401"} 1`))
+			Ω(metrics).ShouldNot(ContainSubstring("made-up-suffix"))
+		})
+
+		It("counts backend errors", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"), ghttp.RespondWith(500, "{}"))
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("GET", "/space1/v2/catalog", "")
+
+			backend.RouteToHandler("GET", "/v2/catalog", func(w http.ResponseWriter, req *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				Ω(err).ShouldNot(HaveOccurred())
+				conn.Close()
+			})
+			makeRequest("GET", "/space1/v2/catalog", "")
+
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`buddy_backend_errors_total{operation="catalog",suffix="space1",backend="redis",status="500"} 1`))
+			Ω(metrics).Should(ContainSubstring(`buddy_backend_errors_total{operation="catalog",suffix="space1",backend="redis",status="error"} 1`))
+		})
+	})
+
+	Describe("Test registry gauges", func() {
+		It("exports instances and bindings in the registry", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(202, "{}"),
+			)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", "")
+
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`buddy_registry_instances{suffix="space1",backend="redis"} 1`))
+			Ω(metrics).Should(ContainSubstring(`buddy_registry_deprovisioning_instances{suffix="space1",backend="redis"} 1`))
+			Ω(metrics).Should(ContainSubstring(`buddy_registry_bindings{suffix="space1",backend="redis"} 1`))
+		})
+	})
+
+	Describe("Test metrics credentials", func() {
+		It("protects the metrics with their own credentials", func() {
+			config.Admin = &AdminConfig{Username: "admin", Password: "admin-secret"}
+			config.Metrics = &MetricsConfig{Username: "prometheus", Password: "scrape-secret"}
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-metrics-tests"), config)
+
+			scrapeAs := func(username, password string) int {
+				recorder := httptest.NewRecorder()
+				request, _ := http.NewRequest("GET", "/metrics", nil)
+				request.SetBasicAuth(username, password)
+				brokerAPI.ServeHTTP(recorder, request)
+				return recorder.Code
+			}
+			Ω(makeRequest("GET", "/metrics", "").Code).Should(Equal(401))
+			Ω(scrapeAs("admin", "admin-secret")).Should(Equal(401))
+			Ω(scrapeAs("prometheus", "scrape-secret")).Should(Equal(200))
+		})
+
+		It("requires a username and password", func() {
+			config.Metrics = &MetricsConfig{Username: "prometheus"}
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("metrics: username and password are required")))
+		})
+	})
+
+	Describe("Test admin credentials", func() {
+		It("protects the metrics with the admin credentials", func() {
+			config.Admin = &AdminConfig{Username: "admin", Password: "admin-secret"}
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-metrics-tests"), config)
+
+			Ω(makeRequest("GET", "/metrics", "").Code).Should(Equal(401))
+
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/metrics", nil)
+			request.SetBasicAuth("admin", "admin-secret")
+			brokerAPI.ServeHTTP(recorder, request)
+			Ω(recorder.Code).Should(Equal(200))
+		})
+	})
+})
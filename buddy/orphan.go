@@ -0,0 +1,161 @@
+package buddy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	defaultOrphanAttempts = 5
+	defaultOrphanBackoff  = time.Second
+	// maxOrphanAttempts recorded; older attempts are dropped
+	maxOrphanAttempts = 1000
+)
+
+// OrphanAttempt is one compensating DELETE buddy sent for a service instance
+// or binding a backend broker may have created while failing to provision or
+// bind it
+type OrphanAttempt struct {
+	Suffix     string    `json:"suffix"`
+	InstanceID string    `json:"instance_id"`
+	BindingID  string    `json:"binding_id,omitempty"`
+	Backend    string    `json:"backend"`
+	Reason     string    `json:"reason"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Done       bool      `json:"done"`
+	Time       time.Time `json:"time"`
+}
+
+// orphanLog keeps the latest orphan mitigation attempts in memory
+type orphanLog struct {
+	mutex    sync.Mutex
+	attempts []OrphanAttempt
+}
+
+func (l *orphanLog) add(attempt OrphanAttempt) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.attempts = append(l.attempts, attempt)
+	if len(l.attempts) > maxOrphanAttempts {
+		l.attempts = l.attempts[len(l.attempts)-maxOrphanAttempts:]
+	}
+}
+
+func (l *orphanLog) list() []OrphanAttempt {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	attempts := make([]OrphanAttempt, len(l.attempts))
+	copy(attempts, l.attempts)
+	return attempts
+}
+
+// orphan is a service instance or binding to delete on a backend broker
+type orphan struct {
+	suffix     string
+	instanceID string
+	bindingID  string
+	backend    backendBroker
+	details    requestDetails
+	header     http.Header
+	reason     string
+}
+
+// needsOrphanMitigation is true when a backend broker may have created a
+// resource it did not report: the call timed out or failed on the way, or
+// the backend answered with a server error. Calls stopped by an open circuit
+// were never sent.
+func needsOrphanMitigation(status int, err error) bool {
+	if err != nil {
+		_, open := err.(circuitOpenError)
+		return !open
+	}
+	return status >= 500
+}
+
+// orphanReason describes why an orphan is deleted
+func orphanReason(status int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("backend broker answered %d", status)
+}
+
+// mitigateOrphan deletes an orphan in the background when orphan mitigation
+// is enabled
+func (b AppHandler) mitigateOrphan(o orphan) {
+	if b.OrphanMitigation == nil {
+		return
+	}
+	o.header = o.header.Clone()
+	go b.deleteOrphan(o)
+}
+
+// deleteOrphan sends DELETEs for an orphan until the backend broker accepts
+// one or the attempts run out, waiting twice as long before each next one
+func (b AppHandler) deleteOrphan(o orphan) {
+	query := url.Values{}
+	query.Set("service_id", o.details.ServiceID)
+	query.Set("plan_id", o.details.PlanID)
+	path := fmt.Sprintf("/v2/service_instances/%s", o.instanceID)
+	operation := "deprovision"
+	if o.bindingID != "" {
+		path = fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", o.instanceID, o.bindingID)
+		operation = "unbind"
+	}
+	query.Set("accepts_incomplete", "true")
+	url := o.backend.URL + path + "?" + query.Encode()
+	data := lager.Data{"suffix": o.suffix, "instance_id": o.instanceID, "binding_id": o.bindingID, "backend": o.backend.label()}
+
+	for attempt := 1; attempt <= b.OrphanMitigation.Attempts; attempt++ {
+		record := OrphanAttempt{
+			Suffix:     o.suffix,
+			InstanceID: o.instanceID,
+			BindingID:  o.bindingID,
+			Backend:    o.backend.label(),
+			Reason:     o.reason,
+			Attempt:    attempt,
+			Time:       time.Now().UTC(),
+		}
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err == nil {
+			req.Header = o.header
+			var resp *http.Response
+			resp, err = b.sendBackend(o.backend, req, time.Now().Add(b.timeout(o.backend, operation)))
+			if err == nil {
+				record.Status = resp.StatusCode
+				resp.Body.Close()
+			}
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		switch record.Status {
+		case http.StatusOK, http.StatusAccepted, http.StatusGone:
+			record.Done = true
+		}
+		b.orphans.add(record)
+		if record.Done {
+			b.Logger.Info("orphan-mitigation", lager.Data{"attempt": attempt, "status": record.Status}, data)
+			return
+		}
+
+		b.Logger.Error("orphan-mitigation-attempt", err, lager.Data{"attempt": attempt, "status": record.Status}, data)
+		if attempt < b.OrphanMitigation.Attempts {
+			time.Sleep(time.Duration(float64(b.OrphanMitigation.Backoff) * math.Pow(2, float64(attempt-1))))
+		}
+	}
+	b.Logger.Error("orphan-mitigation-failed", fmt.Errorf("Gave up deleting orphan after %d attempts", b.OrphanMitigation.Attempts), data)
+}
+
+// listOrphans shows the recorded orphan mitigation attempts, oldest first
+func (b AppHandler) listOrphans(w http.ResponseWriter, req *http.Request) {
+	b.respond(w, http.StatusOK, b.orphans.list())
+}
@@ -0,0 +1,142 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Orphan mitigation", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		config = Config{
+			Backends:         []BackendConfig{{Name: "redis", URL: backend.URL()}},
+			Admin:            &AdminConfig{Username: "admin", Password: "admin-secret"},
+			Auth:             &AuthConfig{Username: "buddy", Password: "secret"},
+			OrphanMitigation: &OrphanMitigationConfig{Attempts: 3, Backoff: time.Millisecond},
+		}
+	})
+
+	JustBeforeEach(func() {
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-orphan-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		request.SetBasicAuth("buddy", "secret")
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	orphans := func() []OrphanAttempt {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/admin/orphans", nil)
+		request.SetBasicAuth("admin", "admin-secret")
+		brokerAPI.ServeHTTP(recorder, request)
+		Ω(recorder.Code).Should(Equal(200))
+		var attempts []OrphanAttempt
+		Ω(json.Unmarshal(recorder.Body.Bytes(), &attempts)).Should(Succeed())
+		return attempts
+	}
+
+	Describe("Test provision", func() {
+		It("deletes the instance a failed provision may have left", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(500, "{}"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1", "accepts_incomplete=true&plan_id=small&service_id=redis"),
+					ghttp.RespondWith(200, "{}"),
+				),
+			)
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Code).Should(Equal(500))
+			Eventually(orphans).Should(HaveLen(1))
+			attempt := orphans()[0]
+			Ω(attempt.Suffix).Should(Equal("space1"))
+			Ω(attempt.InstanceID).Should(Equal("instance1"))
+			Ω(attempt.Backend).Should(Equal("redis"))
+			Ω(attempt.Status).Should(Equal(200))
+			Ω(attempt.Done).Should(BeTrue())
+		})
+
+		It("retries until the backend broker accepts the delete", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(503, "{}"),
+				ghttp.RespondWith(500, "{}"),
+				ghttp.RespondWith(410, "{}"),
+			)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Eventually(orphans).Should(HaveLen(2))
+			attempts := orphans()
+			Ω(attempts[0].Done).Should(BeFalse())
+			Ω(attempts[1].Attempt).Should(Equal(2))
+			Ω(attempts[1].Done).Should(BeTrue())
+		})
+
+		It("leaves successful provisions alone", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Consistently(backend.ReceivedRequests, "50ms").Should(HaveLen(1))
+			Ω(orphans()).Should(BeEmpty())
+		})
+	})
+
+	Describe("Test bind", func() {
+		It("deletes the binding a failed bind may have left", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(502, "{}"),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1/service_bindings/binding1"),
+					ghttp.RespondWith(200, "{}"),
+				),
+			)
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Code).Should(Equal(502))
+			Eventually(orphans).Should(HaveLen(1))
+			Ω(orphans()[0].BindingID).Should(Equal("binding1"))
+			Ω(orphans()[0].Done).Should(BeTrue())
+		})
+	})
+
+	Describe("Test config", func() {
+		It("is off unless configured", func() {
+			config.OrphanMitigation = nil
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-orphan-tests"), config)
+			backend.AppendHandlers(ghttp.RespondWith(500, "{}"))
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Consistently(backend.ReceivedRequests, "50ms").Should(HaveLen(1))
+		})
+	})
+})
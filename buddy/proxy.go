@@ -0,0 +1,315 @@
+package buddy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Call is an OSB request on its way through buddy to a backend broker
+type Call struct {
+	Operation  string
+	Suffix     string
+	InstanceID string
+	BindingID  string
+	// Backend is the label of the backend broker, set once it is picked
+	Backend string
+
+	handler         AppHandler
+	backend         backendBroker
+	details         requestDetails
+	platformVersion apiVersion
+}
+
+// RequestRewriter changes a request before it is sent to a backend broker.
+// The request has the backend path and the platform's query and body; the
+// backend broker is not picked yet.
+type RequestRewriter interface {
+	RewriteRequest(call *Call, req *http.Request) error
+}
+
+// ResponseRewriter changes a backend broker's response before it is
+// streamed to the platform
+type ResponseRewriter interface {
+	RewriteResponse(call *Call, resp *http.Response) error
+}
+
+// RequestRewriterFunc is a function used as a RequestRewriter
+type RequestRewriterFunc func(call *Call, req *http.Request) error
+
+// RewriteRequest calls f(call, req)
+func (f RequestRewriterFunc) RewriteRequest(call *Call, req *http.Request) error {
+	return f(call, req)
+}
+
+// ResponseRewriterFunc is a function used as a ResponseRewriter
+type ResponseRewriterFunc func(call *Call, resp *http.Response) error
+
+// RewriteResponse calls f(call, resp)
+func (f ResponseRewriterFunc) RewriteResponse(call *Call, resp *http.Response) error {
+	return f(call, resp)
+}
+
+// rejection answers a request in place of a backend broker
+type rejection struct {
+	status   int
+	response interface{}
+}
+
+func (r rejection) Error() string {
+	if response, ok := r.response.(errorResponse); ok {
+		return response.Description
+	}
+	return http.StatusText(r.status)
+}
+
+// rejectf answers a request with status and an OSB error description
+func rejectf(status int, format string, args ...interface{}) error {
+	return rejection{status: status, response: errorResponse{Description: fmt.Sprintf(format, args...)}}
+}
+
+// ReverseProxy sends an OSB endpoint on to the backend broker owning the
+// request. Requests go through the RequestRewriters in order, then to the
+// backend broker; its response goes through the ResponseRewriters and is
+// streamed back.
+type ReverseProxy struct {
+	Operation         string
+	RequestRewriters  []RequestRewriter
+	ResponseRewriters []ResponseRewriter
+	// MitigateOrphans deletes what the backend broker may have created when
+	// it fails, if orphan mitigation is enabled
+	MitigateOrphans bool
+	// EmulateAsync answers asynchronously for backend brokers whose API
+	// version can't, when the platform accepts it
+	EmulateAsync bool
+}
+
+// hopHeaders belong to a single connection and are not proxied.
+// Content-Length goes too, as rewriters may change the body.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxy routes an OSB endpoint through a ReverseProxy
+func (b AppHandler) proxy(p ReverseProxy) http.HandlerFunc {
+	return b.route(p.Operation, p.serve)
+}
+
+func (p ReverseProxy) serve(b AppHandler, w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	call := &Call{
+		Operation:  p.Operation,
+		Suffix:     vars["suffix"],
+		InstanceID: vars["instance_id"],
+		BindingID:  vars["binding_id"],
+		handler:    b,
+
+		platformVersion: platformVersion(req.Header),
+	}
+
+	backendReq, err := p.newBackendRequest(call, req)
+	if err != nil {
+		b.respondError(w, "backend-"+p.Operation+"-req", err)
+		return
+	}
+	// Rewriters may have found the details elsewhere, e.g. in the registry
+	if details := requestDetailsOf(backendReq); details.ServiceID != "" || details.PlanID != "" {
+		call.details = details
+	}
+	backend, err := b.ownerBackendBroker(req, call.Suffix, call.InstanceID, call.details.ServiceID, call.details.PlanID)
+	if err != nil {
+		b.respondError(w, "backend-"+p.Operation+"-owner", err)
+		return
+	}
+	call.backend = backend
+	call.Backend = backend.label()
+	backendReq.URL, err = url.Parse(backend.URL + backendReq.URL.RequestURI())
+	if err != nil {
+		b.respondError(w, "backend-"+p.Operation+"-req", err)
+		return
+	}
+	backendReq.Host = backendReq.URL.Host
+	backendReq.Header = b.backendHeader(backend, backendReq.Header)
+	if b.DashboardClientMode == suffixDashboardClients {
+		backendReq.Header.Set(suffixHeader, call.Suffix)
+	}
+	if p.emulatesAsync(backend, backendReq) {
+		p.serveAsync(b, w, call, backendReq)
+		return
+	}
+
+	resp, err := b.roundTrip(backend, p.Operation, backendReq)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if p.MitigateOrphans && needsOrphanMitigation(status, err) {
+		b.mitigateOrphan(orphan{suffix: call.Suffix, instanceID: call.InstanceID, bindingID: call.BindingID, backend: backend, details: call.details, header: backendReq.Header, reason: orphanReason(status, err)})
+	}
+	if err != nil {
+		b.respondBackendError(w, backend, "backend-"+p.Operation+"-resp", err)
+		return
+	}
+	defer resp.Body.Close()
+	b.observeBackend(w, backend, status)
+
+	for _, rewriter := range p.ResponseRewriters {
+		if err := rewriter.RewriteResponse(call, resp); err != nil {
+			b.respondError(w, "backend-"+p.Operation+"-rewrite", err)
+			return
+		}
+	}
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if err := copyFlushing(w, resp.Body); err != nil {
+		b.Logger.Error("backend-"+p.Operation+"-copy", err)
+	}
+}
+
+// newBackendRequest turns the platform's request into one for the backend
+// path, still without a backend broker, and rewrites it
+func (p ReverseProxy) newBackendRequest(call *Call, req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, rejection{status: statusUnprocessableEntity, response: errorResponse{Description: err.Error()}}
+		}
+	}
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/"+call.Suffix)
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	backendReq, err := http.NewRequest(req.Method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	backendReq.Header = req.Header.Clone()
+	for _, rewriter := range p.RequestRewriters {
+		if err := rewriter.RewriteRequest(call, backendReq); err != nil {
+			return nil, err
+		}
+	}
+	return backendReq, nil
+}
+
+// requestDetailsOf reads the routing fields of a request from its body, or
+// failing that from its query
+func requestDetailsOf(req *http.Request) requestDetails {
+	body, _ := requestBody(req)
+	details := parseDetails(body)
+	if details.ServiceID == "" && details.PlanID == "" {
+		details.ServiceID = req.URL.Query().Get("service_id")
+		details.PlanID = req.URL.Query().Get("plan_id")
+	}
+	return details
+}
+
+// requestBody reads the body of a request built by newBackendRequest,
+// leaving it to be read again
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// setRequestBody replaces the body of a request
+func setRequestBody(req *http.Request, data []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// responseBody reads the body of a response, leaving it to be read again.
+// Rewriters that need the body buffer it this way; all other responses are
+// streamed.
+func responseBody(resp *http.Response) ([]byte, error) {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	setResponseBody(resp, data)
+	return data, nil
+}
+
+// setResponseBody replaces the body of a response
+func setResponseBody(resp *http.Response, data []byte) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+}
+
+// copyHeader copies the headers of a backend response, except its API
+// version: buddy advertises its own
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		if name == http.CanonicalHeaderKey(apiVersionHeader) {
+			continue
+		}
+		dst[name] = append([]string{}, values...)
+	}
+	for _, name := range hopHeaders {
+		dst.Del(name)
+	}
+}
+
+// copyFlushing copies a response body, flushing every chunk so the platform
+// gets it as it comes
+func copyFlushing(w http.ResponseWriter, body io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// respondError answers a request that failed before reaching a backend
+// broker; rejections are answered as they say, anything else with a 500
+func (b AppHandler) respondError(w http.ResponseWriter, action string, err error) {
+	var r rejection
+	if errors.As(err, &r) {
+		b.respond(w, r.status, r.response)
+		return
+	}
+	b.Logger.Error(action, err)
+	b.respond(w, http.StatusInternalServerError, errorResponse{
+		Description: err.Error(),
+	})
+}
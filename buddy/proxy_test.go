@@ -0,0 +1,141 @@
+package buddy_test
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Reverse proxy", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		config := Config{
+			Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}},
+		}
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-proxy-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	Describe("Test responses", func() {
+		It("passes the backend's headers on", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, `{"dashboard_url":"https://dashboard"}`, http.Header{
+				"Content-Type": {"application/json"},
+				"X-Backend":    {"redis"},
+				"Connection":   {"close"},
+			}))
+
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("PUT", "/space1/v2/service_instances/instance1", bytes.NewBufferString(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+			brokerAPI.ServeHTTP(recorder, request)
+
+			Ω(recorder.Code).Should(Equal(201))
+			Ω(recorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(recorder.Header().Get("X-Backend")).Should(Equal("redis"))
+			Ω(recorder.Header().Get("Connection")).Should(BeEmpty())
+			Ω(recorder.Body.String()).Should(MatchJSON(`{"dashboard_url":"https://dashboard"}`))
+		})
+
+		It("proxies requests without a body", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1", "plan_id=small&service_id=redis"),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", nil)
+			request.Body = nil
+			brokerAPI.ServeHTTP(recorder, request)
+
+			Ω(recorder.Code).Should(Equal(200))
+		})
+
+		It("streams the backend's response", func() {
+			done := make(chan bool)
+			finished := make(chan bool)
+			backend.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				defer close(finished)
+				w.WriteHeader(201)
+				w.Write([]byte("{\n"))
+				w.(http.Flusher).Flush()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+				}
+				w.Write([]byte("}\n"))
+			})
+			server := httptest.NewServer(brokerAPI)
+			defer server.Close()
+
+			client := &http.Client{Timeout: 10 * time.Second}
+			request, _ := http.NewRequest("PUT", server.URL+"/space1/v2/service_instances/instance1/service_bindings/binding1", strings.NewReader(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+			response, err := client.Do(request)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer response.Body.Close()
+
+			reader := bufio.NewReader(response.Body)
+			line, err := reader.ReadString('\n')
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(line).Should(Equal("{\n"))
+			Ω(finished).ShouldNot(BeClosed())
+			close(done)
+			line, err = reader.ReadString('\n')
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(line).Should(Equal("}\n"))
+		})
+
+		It("buffers provision responses to give their IDs the suffix", func() {
+			done := make(chan bool)
+			backend.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(201)
+				w.Write([]byte(`{"service_id":"redis",`))
+				w.(http.Flusher).Flush()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+				}
+				w.Write([]byte(`"operation":"provisioning"}`))
+			})
+			server := httptest.NewServer(brokerAPI)
+			defer server.Close()
+
+			responses := make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				client := &http.Client{Timeout: 10 * time.Second}
+				request, _ := http.NewRequest("PUT", server.URL+"/space1/v2/service_instances/instance1", strings.NewReader(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+				response, err := client.Do(request)
+				Ω(err).ShouldNot(HaveOccurred())
+				responses <- response
+			}()
+
+			Consistently(responses, "200ms").ShouldNot(Receive())
+			close(done)
+			var response *http.Response
+			Eventually(responses, "5s").Should(Receive(&response))
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(body).Should(MatchJSON(`{"service_id":"redis-space1","operation":"provisioning"}`))
+		})
+	})
+})
@@ -0,0 +1,166 @@
+package buddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// redacted replaces every masked value in the logs
+const redacted = "[REDACTED]"
+
+// DefaultRedactPaths are masked in the logs unless the config says otherwise:
+// user parameters, binding credentials, dashboard client secrets and
+// anything that looks like a password or token
+var DefaultRedactPaths = []string{
+	"parameters",
+	"credentials",
+	"dashboard_client.secret",
+	"password",
+	"secret",
+	"token",
+	"authorization",
+}
+
+// redactingSink masks JSON paths in the data of every log line before
+// passing it on. A path is a dot-separated list of keys that matches
+// wherever it appears in the data, including inside JSON strings and raw
+// JSON; array elements are looked through.
+type redactingSink struct {
+	sink  lager.Sink
+	paths [][]string
+}
+
+// NewRedactingSink returns a sink that masks paths before logging to sink
+func NewRedactingSink(sink lager.Sink, paths []string) lager.Sink {
+	s := &redactingSink{sink: sink}
+	for _, path := range paths {
+		s.paths = append(s.paths, strings.Split(path, "."))
+	}
+	return s
+}
+
+// NewLogger returns a logger writing JSON lines to out at the level of the
+// config, redacting the configured paths
+func NewLogger(component string, config Config, out io.Writer) lager.Logger {
+	level, _ := parseLogLevel(config.LogLevel)
+	paths := config.Redact
+	if paths == nil {
+		paths = DefaultRedactPaths
+	}
+	logger := lager.NewLogger(component)
+	logger.RegisterSink(NewRedactingSink(lager.NewWriterSink(out, level), paths))
+	return logger
+}
+
+// parseLogLevel reads debug, info, error or fatal; empty means info
+func parseLogLevel(level string) (lager.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return lager.DEBUG, nil
+	case "", "info":
+		return lager.INFO, nil
+	case "error":
+		return lager.ERROR, nil
+	case "fatal":
+		return lager.FATAL, nil
+	}
+	return lager.INFO, fmt.Errorf("log_level must be debug, info, error or fatal, not %q", level)
+}
+
+func (s *redactingSink) Log(log lager.LogFormat) {
+	data := lager.Data{}
+	for key, value := range log.Data {
+		data[key] = s.redact([]string{key}, value)
+	}
+	log.Data = data
+	s.sink.Log(log)
+}
+
+// redact masks value when its path matches, and the matching paths inside it
+func (s *redactingSink) redact(path []string, value interface{}) interface{} {
+	if s.matches(path) {
+		return redacted
+	}
+	switch v := value.(type) {
+	case nil, bool, int, int64, float64, error:
+		return value
+	case string:
+		if !looksLikeJSON([]byte(v)) {
+			return v
+		}
+		return s.redactJSON(path, []byte(v), v)
+	case []byte:
+		return s.redactJSON(path, v, string(v))
+	case json.RawMessage:
+		// invalid raw JSON would break the encoding of the whole log line
+		return s.redactJSON(path, v, string(v))
+	case lager.Data:
+		return s.redactObject(path, v)
+	case map[string]interface{}:
+		return s.redactObject(path, v)
+	case []interface{}:
+		redactedValues := make([]interface{}, len(v))
+		for i, element := range v {
+			redactedValues[i] = s.redact(path, element)
+		}
+		return redactedValues
+	}
+	// anything else is looked at through its JSON encoding
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	return s.redactJSON(path, data, value)
+}
+
+func (s *redactingSink) redactObject(path []string, object map[string]interface{}) map[string]interface{} {
+	redactedObject := map[string]interface{}{}
+	for key, value := range object {
+		redactedObject[key] = s.redact(append(path[:len(path):len(path)], key), value)
+	}
+	return redactedObject
+}
+
+// redactJSON masks the paths inside JSON data. Data that is no JSON object
+// or array is logged as original.
+func (s *redactingSink) redactJSON(path []string, data []byte, original interface{}) interface{} {
+	if !looksLikeJSON(data) {
+		return original
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return original
+	}
+	return s.redact(path, value)
+}
+
+// matches is true when a configured path is the tail of path
+func (s *redactingSink) matches(path []string) bool {
+	for _, redactPath := range s.paths {
+		if len(redactPath) > len(path) {
+			continue
+		}
+		tail := path[len(path)-len(redactPath):]
+		matched := true
+		for i, key := range redactPath {
+			if !strings.EqualFold(key, tail[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func looksLikeJSON(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && (data[0] == '{' || data[0] == '[')
+}
@@ -0,0 +1,132 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Redact", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+		logs      *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		logs = &bytes.Buffer{}
+		config = Config{
+			Backends: []BackendConfig{{Name: "default", URL: backend.URL()}},
+			LogLevel: "debug",
+		}
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(NewLogger("buddy-redact-tests", config, logs), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test broker logs", func() {
+		It("never logs the dashboard client secret of a catalog", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"services":[{"id":"redis","name":"redis","dashboard_client":{"id":"dashboard","secret":"dashboard-secret"},"plans":[]}]}`))
+
+			Ω(makeRequest("GET", "/space1/v2/catalog", "").Code).Should(Equal(200))
+
+			Ω(logs.String()).Should(ContainSubstring("backend-catalog"))
+			Ω(logs.String()).Should(ContainSubstring(`"id":"dashboard"`))
+			Ω(logs.String()).ShouldNot(ContainSubstring("dashboard-secret"))
+		})
+
+		It("never logs the parameters of a provision", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+
+			Ω(makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1","parameters":{"admin_password":"parameter-secret"}}`).Code).Should(Equal(201))
+
+			Ω(logs.String()).Should(ContainSubstring("provision-details"))
+			Ω(logs.String()).Should(ContainSubstring(`"service_id":"redis"`))
+			Ω(logs.String()).ShouldNot(ContainSubstring("parameter-secret"))
+		})
+
+		It("logs no debug lines at the info level", func() {
+			config.LogLevel = "info"
+			brokerAPI = NewWithConfig(NewLogger("buddy-redact-tests", config, logs), config)
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"services":[]}`))
+
+			makeRequest("GET", "/space1/v2/catalog", "")
+
+			Ω(logs.String()).ShouldNot(ContainSubstring("backend-catalog"))
+		})
+	})
+
+	Describe("Test redacting sink", func() {
+		var logger lager.Logger
+
+		BeforeEach(func() {
+			logger = lager.NewLogger("buddy-redact-tests")
+			logger.RegisterSink(NewRedactingSink(lager.NewWriterSink(logs, lager.DEBUG), []string{"password", "binding.credentials"}))
+		})
+
+		It("masks matching keys at any depth", func() {
+			logger.Info("test", lager.Data{
+				"password": "top-secret",
+				"nested":   map[string]interface{}{"list": []interface{}{map[string]interface{}{"password": "nested-secret"}}},
+				"binding":  lager.Data{"credentials": lager.Data{"uri": "redis://credentials-secret"}},
+			})
+
+			Ω(logs.String()).ShouldNot(ContainSubstring("secret"))
+			Ω(logs.String()).Should(ContainSubstring(`"password":"[REDACTED]"`))
+		})
+
+		It("masks inside JSON strings, raw JSON and structs", func() {
+			logger.Info("test", lager.Data{
+				"string": `{"password":"string-secret"}`,
+				"raw":    json.RawMessage(`[{"password":"raw-secret"}]`),
+				"struct": struct {
+					Password string `json:"password"`
+				}{"struct-secret"},
+			})
+
+			Ω(logs.String()).ShouldNot(ContainSubstring("secret"))
+		})
+
+		It("only masks full paths", func() {
+			logger.Info("test", lager.Data{"credentials": "kept", "binding": lager.Data{"id": "kept too"}})
+
+			Ω(logs.String()).Should(ContainSubstring(`"credentials":"kept"`))
+			Ω(logs.String()).Should(ContainSubstring(`"id":"kept too"`))
+		})
+
+		It("logs invalid raw JSON as a string", func() {
+			logger.Error("test", errors.New("failed"), lager.Data{"raw": json.RawMessage(`{not json`)})
+
+			Ω(logs.String()).Should(ContainSubstring(`"raw":"{not json"`))
+		})
+	})
+
+	Describe("Test config", func() {
+		It("rejects unknown log levels", func() {
+			config.LogLevel = "verbose"
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("log_level must be debug, info, error or fatal")))
+		})
+	})
+})
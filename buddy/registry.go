@@ -0,0 +1,374 @@
+package buddy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// Record is what buddy remembers about a service instance or binding it
+// proxied. Instance records have no BindingID.
+type Record struct {
+	Suffix           string    `json:"suffix"`
+	InstanceID       string    `json:"instance_id"`
+	BindingID        string    `json:"binding_id,omitempty"`
+	Backend          string    `json:"backend"`
+	ServiceID        string    `json:"service_id"`
+	PlanID           string    `json:"plan_id"`
+	OrganizationGUID string    `json:"organization_guid,omitempty"`
+	SpaceGUID        string    `json:"space_guid,omitempty"`
+	Deprovisioning   bool      `json:"deprovisioning,omitempty"` // also set on bindings being unbound
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Registry stores the records of instances and bindings provisioned through buddy
+type Registry interface {
+	Save(record Record) error
+	// Find looks up an instance record, or a binding record if bindingID is set
+	Find(instanceID, bindingID string) (Record, bool, error)
+	// Delete removes an instance record together with its bindings, or a
+	// single binding record if bindingID is set
+	Delete(instanceID, bindingID string) error
+	List() ([]Record, error)
+}
+
+type recordKey struct {
+	InstanceID string
+	BindingID  string
+}
+
+type memoryRegistry struct {
+	mutex   sync.RWMutex
+	records map[recordKey]Record
+}
+
+// NewMemoryRegistry returns a registry that forgets everything on restart
+func NewMemoryRegistry() Registry {
+	return &memoryRegistry{records: map[recordKey]Record{}}
+}
+
+func (r *memoryRegistry) Save(record Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records[recordKey{record.InstanceID, record.BindingID}] = record
+	return nil
+}
+
+func (r *memoryRegistry) Find(instanceID, bindingID string) (Record, bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	record, ok := r.records[recordKey{instanceID, bindingID}]
+	return record, ok, nil
+}
+
+func (r *memoryRegistry) Delete(instanceID, bindingID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.delete(instanceID, bindingID)
+	return nil
+}
+
+func (r *memoryRegistry) delete(instanceID, bindingID string) {
+	for key := range r.records {
+		if key.InstanceID == instanceID && (bindingID == "" || key.BindingID == bindingID) {
+			delete(r.records, key)
+		}
+	}
+}
+
+func (r *memoryRegistry) List() ([]Record, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.list(), nil
+}
+
+func (r *memoryRegistry) list() []Record {
+	records := []Record{}
+	for _, record := range r.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].InstanceID != records[j].InstanceID {
+			return records[i].InstanceID < records[j].InstanceID
+		}
+		return records[i].BindingID < records[j].BindingID
+	})
+	return records
+}
+
+// fileRegistry keeps the records in memory and writes all of them to a JSON
+// file on every change
+type fileRegistry struct {
+	memoryRegistry
+	path string
+}
+
+// NewFileRegistry returns a registry persisted in the JSON file at path,
+// loading any records already in it
+func NewFileRegistry(path string) (Registry, error) {
+	r := &fileRegistry{
+		memoryRegistry: memoryRegistry{records: map[recordKey]Record{}},
+		path:           path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		r.records[recordKey{record.InstanceID, record.BindingID}] = record
+	}
+	return r, nil
+}
+
+func (r *fileRegistry) Save(record Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records[recordKey{record.InstanceID, record.BindingID}] = record
+	return r.persist()
+}
+
+func (r *fileRegistry) Delete(instanceID, bindingID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.delete(instanceID, bindingID)
+	return r.persist()
+}
+
+func (r *fileRegistry) persist() error {
+	data, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(r.path, data)
+}
+
+// writeFileAtomically replaces a file with data so a crash never leaves half of it
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// useRegistry keeps the records in memory, or in the configured file
+func (b *AppHandler) useRegistry(config *RegistryConfig) {
+	b.StrictIsolation = config.strict()
+	if config == nil || config.File == "" {
+		b.Logger.Info("registry-not-persisted", lager.Data{"warning": "instances are unisolated after a restart without a registry file"})
+		b.Registry = NewMemoryRegistry()
+		return
+	}
+	registry, err := NewFileRegistry(config.File)
+	if err != nil {
+		b.Logger.Fatal("registry-load", err, lager.Data{"path": config.File})
+	}
+	b.Registry = registry
+	b.Logger.Info("registry", lager.Data{"path": config.File})
+}
+
+// recordInstance records an instance the suffix provisioned. Only
+// provisioning claims an instance for a suffix.
+func (b AppHandler) recordInstance(suffix, instanceID string, backend backendBroker, details requestDetails) {
+	if b.Registry == nil {
+		return
+	}
+	now := time.Now().UTC()
+	record, found, err := b.Registry.Find(instanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": instanceID})
+		return
+	}
+	if found && record.Suffix != suffix {
+		return
+	}
+	if !found {
+		record = Record{Suffix: suffix, InstanceID: instanceID, CreatedAt: now}
+	}
+	b.saveInstance(record, backend, details, now)
+}
+
+// recordUpdate refreshes the record of an instance the suffix updated.
+// Instances buddy has no record of stay unrecorded.
+func (b AppHandler) recordUpdate(suffix, instanceID string, backend backendBroker, details requestDetails) {
+	if b.Registry == nil {
+		return
+	}
+	record, found, err := b.Registry.Find(instanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": instanceID})
+		return
+	}
+	if !found || record.Suffix != suffix {
+		return
+	}
+	b.saveInstance(record, backend, details, time.Now().UTC())
+}
+
+func (b AppHandler) saveInstance(record Record, backend backendBroker, details requestDetails, now time.Time) {
+	record.Backend = backend.label()
+	if details.ServiceID != "" {
+		record.ServiceID = details.ServiceID
+	}
+	if details.PlanID != "" {
+		record.PlanID = details.PlanID
+	}
+	if details.OrganizationGUID != "" {
+		record.OrganizationGUID = details.OrganizationGUID
+	}
+	if details.SpaceGUID != "" {
+		record.SpaceGUID = details.SpaceGUID
+	}
+	record.UpdatedAt = now
+	if err := b.Registry.Save(record); err != nil {
+		b.Logger.Error("registry-save", err, lager.Data{"instance_id": record.InstanceID})
+	}
+}
+
+// recordBinding records a binding of an instance the suffix owns; bindings
+// of instances buddy has no record of stay unrecorded
+func (b AppHandler) recordBinding(suffix, instanceID, bindingID string, backend backendBroker, details requestDetails) {
+	if b.Registry == nil {
+		return
+	}
+	now := time.Now().UTC()
+	record := Record{
+		Suffix:     suffix,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		Backend:    backend.label(),
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	instance, found, err := b.Registry.Find(instanceID, "")
+	if err != nil {
+		b.Logger.Error("registry-find", err, lager.Data{"instance_id": instanceID})
+		return
+	}
+	if !found || instance.Suffix != suffix {
+		return
+	}
+	record.OrganizationGUID = instance.OrganizationGUID
+	record.SpaceGUID = instance.SpaceGUID
+	if err := b.Registry.Save(record); err != nil {
+		b.Logger.Error("registry-save", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+	}
+}
+
+// markDeprovisioning remembers an instance or binding is being deleted
+// asynchronously, so last_operation can forget it once the backend is done
+func (b AppHandler) markDeprovisioning(instanceID, bindingID string) {
+	if b.Registry == nil {
+		return
+	}
+	record, found, err := b.Registry.Find(instanceID, bindingID)
+	if err != nil || !found {
+		return
+	}
+	record.Deprovisioning = true
+	record.UpdatedAt = time.Now().UTC()
+	if err := b.Registry.Save(record); err != nil {
+		b.Logger.Error("registry-save", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+	}
+}
+
+// forget removes an instance with its bindings, or a single binding
+func (b AppHandler) forget(instanceID, bindingID string) {
+	if b.Registry == nil {
+		return
+	}
+	if err := b.Registry.Delete(instanceID, bindingID); err != nil {
+		b.Logger.Error("registry-delete", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+	}
+}
+
+// forgetDeprovisioned removes an instance or binding whose asynchronous
+// deletion has finished, judging by the backend's last_operation response
+func (b AppHandler) forgetDeprovisioned(instanceID, bindingID string, status int, data []byte) {
+	if b.Registry == nil {
+		return
+	}
+	record, found, err := b.Registry.Find(instanceID, bindingID)
+	if err != nil || !found || !record.Deprovisioning {
+		return
+	}
+	var lastOperation struct {
+		State string `json:"state"`
+	}
+	json.Unmarshal(data, &lastOperation)
+	if status == http.StatusGone || (status == http.StatusOK && lastOperation.State == "succeeded") {
+		b.forget(instanceID, bindingID)
+	}
+}
+
+// recordProvisioned records instances the backend broker provisioned
+var recordProvisioned = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		call.handler.recordInstance(call.Suffix, call.InstanceID, call.backend, call.details)
+	}
+	return nil
+})
+
+// recordUpdated refreshes the records of instances the backend broker updated
+var recordUpdated = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		call.handler.recordUpdate(call.Suffix, call.InstanceID, call.backend, call.details)
+	}
+	return nil
+})
+
+// recordBound records bindings the backend broker created
+var recordBound = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		call.handler.recordBinding(call.Suffix, call.InstanceID, call.BindingID, call.backend, call.details)
+	}
+	return nil
+})
+
+// forgetDeleted forgets instances and bindings the backend broker deleted,
+// and marks those it is deleting asynchronously
+var forgetDeleted = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusGone:
+		call.handler.forget(call.InstanceID, call.BindingID)
+	case http.StatusAccepted:
+		call.handler.markDeprovisioning(call.InstanceID, call.BindingID)
+	}
+	return nil
+})
+
+// forgetPolledDeprovision forgets instances and bindings whose asynchronous
+// deletion the backend broker reports finished
+var forgetPolledDeprovision = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	data, err := responseBody(resp)
+	if err != nil {
+		return err
+	}
+	call.handler.forgetDeprovisioned(call.InstanceID, call.BindingID, resp.StatusCode, data)
+	return nil
+})
@@ -0,0 +1,180 @@
+package buddy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Registry", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-registry")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("Test memory registry", func() {
+		It("deletes bindings with their instance", func() {
+			registry := NewMemoryRegistry()
+			Ω(registry.Save(Record{Suffix: "space1", InstanceID: "instance1"})).Should(Succeed())
+			Ω(registry.Save(Record{Suffix: "space1", InstanceID: "instance1", BindingID: "binding1"})).Should(Succeed())
+			Ω(registry.Save(Record{Suffix: "space1", InstanceID: "instance2"})).Should(Succeed())
+
+			Ω(registry.Delete("instance1", "")).Should(Succeed())
+
+			records, err := registry.List()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(records).Should(HaveLen(1))
+			Ω(records[0].InstanceID).Should(Equal("instance2"))
+		})
+	})
+
+	Describe("Test file registry", func() {
+		It("keeps records across restarts", func() {
+			path := filepath.Join(tmpDir, "registry.json")
+			registry, err := NewFileRegistry(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(registry.Save(Record{Suffix: "space1", InstanceID: "instance1", ServiceID: "redis"})).Should(Succeed())
+
+			registry, err = NewFileRegistry(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			record, found, err := registry.Find("instance1", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(found).Should(BeTrue())
+			Ω(record.Suffix).Should(Equal("space1"))
+			Ω(record.ServiceID).Should(Equal("redis"))
+		})
+	})
+
+	Describe("Test handler pipeline", func() {
+		var (
+			backend   *ghttp.Server
+			brokerAPI http.Handler
+			path      string
+		)
+
+		BeforeEach(func() {
+			backend = ghttp.NewServer()
+			path = filepath.Join(tmpDir, "registry.json")
+			os.Setenv("BACKEND_BROKER", backend.URL())
+			os.Setenv("REGISTRY_FILE", path)
+			brokerAPI = New(lager.NewLogger("buddy-registry-tests"))
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("REGISTRY_FILE")
+			backend.Close()
+		})
+
+		makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+			brokerAPI.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		records := func() []Record {
+			registry, err := NewFileRegistry(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			records, err := registry.List()
+			Ω(err).ShouldNot(HaveOccurred())
+			return records
+		}
+
+		It("records provisioned instances and bindings", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"), ghttp.RespondWith(201, "{}"))
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1",
+				`{"service_id":"redis-space1","plan_id":"small-space1","organization_guid":"org","space_guid":"space"}`)
+			makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1",
+				`{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(records()).Should(HaveLen(2))
+			instance, binding := records()[0], records()[1]
+			Ω(instance.Suffix).Should(Equal("space1"))
+			Ω(instance.ServiceID).Should(Equal("redis"))
+			Ω(instance.PlanID).Should(Equal("small"))
+			Ω(instance.OrganizationGUID).Should(Equal("org"))
+			Ω(instance.SpaceGUID).Should(Equal("space"))
+			Ω(instance.CreatedAt.IsZero()).Should(BeFalse())
+			Ω(binding.BindingID).Should(Equal("binding1"))
+			Ω(binding.SpaceGUID).Should(Equal("space"))
+		})
+
+		It("does not record failed provisions", func() {
+			backend.AppendHandlers(ghttp.RespondWith(500, "{}"))
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(records()).Should(BeEmpty())
+		})
+
+		It("removes records on unbind and deprovision", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(200, "{}"),
+				ghttp.RespondWith(200, "{}"),
+			)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("DELETE", "/space1/v2/service_instances/instance1/service_bindings/binding1?service_id=redis-space1&plan_id=small-space1", "")
+			Ω(records()).Should(HaveLen(1))
+
+			makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", "")
+			Ω(records()).Should(BeEmpty())
+		})
+
+		It("removes asynchronously deprovisioned instances once the backend is done", func() {
+			backend.AppendHandlers(
+				ghttp.RespondWith(201, "{}"),
+				ghttp.RespondWith(202, "{}"),
+				ghttp.RespondWith(200, `{"state":"in progress"}`),
+				ghttp.RespondWith(410, "{}"),
+			)
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", "")
+			makeRequest("GET", "/space1/v2/service_instances/instance1/last_operation", "")
+			Ω(records()).Should(HaveLen(1))
+
+			makeRequest("GET", "/space1/v2/service_instances/instance1/last_operation", "")
+			Ω(records()).Should(BeEmpty())
+		})
+
+		It("persists records in the file of the config", func() {
+			configPath := filepath.Join(tmpDir, "config-registry.json")
+			brokerAPI = NewWithConfig(lager.NewLogger("buddy-registry-tests"), Config{
+				Backends: []BackendConfig{{Name: "default", URL: backend.URL()}},
+				Registry: &RegistryConfig{File: configPath},
+			})
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+
+			makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			registry, err := NewFileRegistry(configPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, found, err := registry.Find("instance1", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(found).Should(BeTrue())
+			Ω(records()).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,168 @@
+package buddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// suffixedIDFields are the OSB request fields holding IDs from the suffixed catalog
+var suffixedIDFields = []string{"service_id", "plan_id"}
+
+// unsuffixRequestBody translates service_id, plan_id,
+// previous_values.service_id and previous_values.plan_id of a JSON request
+// body back to the backend IDs. All other fields are passed on untouched.
+var unsuffixRequestBody = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	data, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	data, err = unsuffixBody(data, call.backendIDs(req))
+	if err != nil {
+		return rejection{status: statusUnprocessableEntity, response: errorResponse{Description: err.Error()}}
+	}
+	setRequestBody(req, data)
+	return nil
+})
+
+// unsuffixRequestQuery translates the service_id and plan_id query
+// parameters back to the backend IDs
+var unsuffixRequestQuery = RequestRewriterFunc(func(call *Call, req *http.Request) error {
+	query := unsuffixQuery(req.URL.Query(), call.backendIDs(req))
+	req.URL.RawQuery = query.Encode()
+	return nil
+})
+
+// suffixResponseBody gives the IDs in a successful JSON response body the
+// IDs of the call's suffix: service_id and plan_id. dashboard_url is left as
+// the backend sent it: it points at the backend's own dashboard, which only
+// knows the backend IDs, and buddy doesn't proxy dashboards. Bodies that are
+// no JSON object, or hold none of these IDs, are passed on untouched. The
+// whole body is read first, so provision, update and fetch responses aren't
+// streamed.
+var suffixResponseBody = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil
+	}
+	data, err := responseBody(resp)
+	if err != nil {
+		return err
+	}
+	var fields rawObject
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil
+	}
+	if !suffixFields(fields, func(id string) string {
+		return call.handler.IDs.SuffixID(call.Suffix, id)
+	}) {
+		return nil
+	}
+	data, err = marshalJSON(fields)
+	if err != nil {
+		return err
+	}
+	setResponseBody(resp, data)
+	return nil
+})
+
+// suffixFields rewrites the IDs in the fields of a response, telling whether
+// there were any
+func suffixFields(fields rawObject, suffixID func(string) string) bool {
+	changed := false
+	for _, name := range suffixedIDFields {
+		if id := fields.stringField(name); id != "" {
+			fields.setStringField(name, suffixID(id))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// backendIDs translates the IDs of the call's suffix back
+func (call *Call) backendIDs(req *http.Request) func(string) string {
+	return func(id string) string {
+		return call.handler.backendID(call.Suffix, id, req.Header)
+	}
+}
+
+func unsuffixBody(data []byte, backendID func(string) string) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return data, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if err := unsuffixFields(fields, backendID); err != nil {
+		return nil, err
+	}
+
+	if raw, ok := fields["previous_values"]; ok {
+		var previousValues map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &previousValues); err != nil {
+			return nil, fmt.Errorf("previous_values must be an object: %s", err)
+		}
+		if previousValues != nil {
+			if err := unsuffixFields(previousValues, backendID); err != nil {
+				return nil, fmt.Errorf("previous_values.%s", err)
+			}
+			raw, err := json.Marshal(previousValues)
+			if err != nil {
+				return nil, err
+			}
+			fields["previous_values"] = raw
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func unsuffixFields(fields map[string]json.RawMessage, backendID func(string) string) error {
+	for _, name := range suffixedIDFields {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var id string
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		raw, err := json.Marshal(backendID(id))
+		if err != nil {
+			return err
+		}
+		fields[name] = raw
+	}
+	return nil
+}
+
+// unsuffixQuery returns a copy of query with the service_id and plan_id
+// parameters translated back to the backend IDs
+func unsuffixQuery(query url.Values, backendID func(string) string) url.Values {
+	rewritten := url.Values{}
+	for name, values := range query {
+		rewritten[name] = append([]string{}, values...)
+	}
+	for _, name := range suffixedIDFields {
+		for i, value := range rewritten[name] {
+			rewritten[name][i] = backendID(value)
+		}
+	}
+	return rewritten
+}
+
+// requestDetails are the OSB request body fields buddy routes and records by
+type requestDetails struct {
+	ServiceID        string `json:"service_id"`
+	PlanID           string `json:"plan_id"`
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+}
+
+// parseDetails reads the routing fields from a JSON request body
+func parseDetails(body []byte) requestDetails {
+	var details requestDetails
+	json.Unmarshal(body, &details)
+	return details
+}
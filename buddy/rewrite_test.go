@@ -0,0 +1,227 @@
+package buddy_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Rewrite", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		os.Setenv("BACKEND_BROKER", backend.URL())
+		brokerAPI = New(lager.NewLogger("buddy-rewrite-tests"))
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json")
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test request bodies", func() {
+		It("strips the suffix from provision IDs and keeps other fields", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1"),
+				ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"small","organization_guid":"org","space_guid":"space","context":{"platform":"cloudfoundry"},"parameters":{"plan_id":"small-space1"}}`),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1",
+				`{"service_id":"redis-space1","plan_id":"small-space1","organization_guid":"org","space_guid":"space","context":{"platform":"cloudfoundry"},"parameters":{"plan_id":"small-space1"}}`)
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("strips the suffix from update IDs and previous values", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/v2/service_instances/instance1"),
+				ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"large","previous_values":{"service_id":"redis","plan_id":"small","organization_id":"org"}}`),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			response := makeRequest("PATCH", "/space1/v2/service_instances/instance1",
+				`{"service_id":"redis-space1","plan_id":"large-space1","previous_values":{"service_id":"redis-space1","plan_id":"small-space1","organization_id":"org"}}`)
+
+			Ω(response.Code).Should(Equal(200))
+		})
+
+		It("strips the suffix from bind IDs", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1/service_bindings/binding1"),
+				ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"small","app_guid":"app"}`),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1/service_bindings/binding1",
+				`{"service_id":"redis-space1","plan_id":"small-space1","app_guid":"app"}`)
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("rejects IDs that are not strings", func() {
+			response := makeRequest("PATCH", "/space1/v2/service_instances/instance1", `{"service_id":1}`)
+
+			Ω(response.Code).Should(Equal(422))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(0))
+		})
+	})
+
+	Describe("Test query parameters", func() {
+		It("strips the suffix from deprovision IDs", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1", "plan_id=small&service_id=redis"),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+		})
+
+		It("strips the suffix from unbind IDs", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1/service_bindings/binding1", "plan_id=small&service_id=redis"),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1/service_bindings/binding1?service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+		})
+	})
+
+	Describe("Test async provisioning", func() {
+		It("forwards accepts_incomplete and last_operation parameters", func() {
+			backend.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1", "accepts_incomplete=true"),
+					ghttp.VerifyJSON(`{"service_id":"redis","plan_id":"small"}`),
+					ghttp.RespondWith(202, `{"operation":"op1"}`),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v2/service_instances/instance1/last_operation", "operation=op1&plan_id=small&service_id=redis"),
+					ghttp.RespondWith(200, `{"state":"in progress"}`),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v2/service_instances/instance1/last_operation", "operation=op1&plan_id=small&service_id=redis"),
+					ghttp.RespondWith(200, `{"state":"succeeded"}`),
+				),
+			)
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1?accepts_incomplete=true",
+				`{"service_id":"redis-space1","plan_id":"small-space1"}`)
+			Ω(response.Code).Should(Equal(202))
+			Ω(response.Body.String()).Should(MatchJSON(`{"operation":"op1"}`))
+
+			lastOperation := "/space1/v2/service_instances/instance1/last_operation?operation=op1&service_id=redis-space1&plan_id=small-space1"
+			response = makeRequest("GET", lastOperation, "")
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body.String()).Should(MatchJSON(`{"state":"in progress"}`))
+
+			response = makeRequest("GET", lastOperation, "")
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body.String()).Should(MatchJSON(`{"state":"succeeded"}`))
+		})
+
+		It("forwards accepts_incomplete on update", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PATCH", "/v2/service_instances/instance1", "accepts_incomplete=true"),
+				ghttp.RespondWith(202, `{"operation":"op2"}`),
+			))
+
+			response := makeRequest("PATCH", "/space1/v2/service_instances/instance1?accepts_incomplete=true", `{"service_id":"redis-space1","plan_id":"large-space1"}`)
+
+			Ω(response.Code).Should(Equal(202))
+		})
+
+		It("forwards accepts_incomplete on deprovision", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1", "accepts_incomplete=true&plan_id=small&service_id=redis"),
+				ghttp.RespondWith(202, `{"operation":"op3"}`),
+			))
+
+			response := makeRequest("DELETE", "/space1/v2/service_instances/instance1?accepts_incomplete=true&service_id=redis-space1&plan_id=small-space1", "")
+
+			Ω(response.Code).Should(Equal(202))
+		})
+	})
+
+	Describe("Test response bodies", func() {
+		It("suffixes IDs echoed by provision responses", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, `{"service_id":"redis","plan_id":"small","operation":"op1"}`))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Code).Should(Equal(201))
+			Ω(response.Body).Should(MatchJSON(`{"service_id":"redis-space1","plan_id":"small-space1","operation":"op1"}`))
+		})
+
+		It("leaves dashboard URLs pointing at the backend IDs", func() {
+			body := `{"dashboard_url":"https://dashboard.example.com/plans/large/instances/instance1?plan=large","operation":"op2"}`
+			backend.AppendHandlers(ghttp.RespondWith(202, body))
+
+			response := makeRequest("PATCH", "/space1/v2/service_instances/instance1?accepts_incomplete=true", `{"service_id":"redis-space1","plan_id":"large-space1"}`)
+
+			Ω(response.Code).Should(Equal(202))
+			Ω(response.Body.String()).Should(Equal(body))
+		})
+
+		It("suffixes the IDs of fetched instances", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"service_id":"redis","plan_id":"small","dashboard_url":"https://redis.example.com/redis/small","parameters":{"plan_id":"small"}}`))
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1?service_id=redis-space1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"service_id":"redis-space1","plan_id":"small-space1","dashboard_url":"https://redis.example.com/redis/small","parameters":{"plan_id":"small"}}`))
+		})
+
+		It("passes fetched bindings on untouched", func() {
+			body := `{"credentials":{"plan_id":"small","uri":"redis://redis.example.com/small"}}`
+			backend.AppendHandlers(ghttp.RespondWith(200, body))
+
+			response := makeRequest("GET", "/space1/v2/service_instances/instance1/service_bindings/binding1", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body.String()).Should(Equal(body))
+		})
+
+		It("passes bodies without IDs on untouched", func() {
+			body := `{"dashboard_url": "https://dashboard.example.com/instance1"}`
+			backend.AppendHandlers(ghttp.RespondWith(201, body))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Body.String()).Should(Equal(body))
+		})
+
+		It("passes errors on untouched", func() {
+			body := `{"description":"plan small is sold out","service_id":"redis"}`
+			backend.AppendHandlers(ghttp.RespondWith(422, body))
+
+			response := makeRequest("PUT", "/space1/v2/service_instances/instance1", `{"service_id":"redis-space1","plan_id":"small-space1"}`)
+
+			Ω(response.Code).Should(Equal(422))
+			Ω(response.Body.String()).Should(Equal(body))
+		})
+	})
+})
@@ -0,0 +1,70 @@
+package buddy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+// route serves an OSB operation. It identifies the request by the platform's
+// request ID, or a new one, in the logs, the response and the backend calls,
+// traces it, counts it, and checks the broker credentials and API version.
+func (b AppHandler) route(operation string, handle func(AppHandler, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := requestID(req)
+		req.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+		w.Header().Set(apiVersionHeader, brokerAPIVersion.String())
+
+		rb := b
+		rb.Logger = b.Logger.WithData(lager.Data{"request_id": id})
+		var span *Span
+		if b.Tracer != nil {
+			span = b.Tracer.start("osb "+operation, spanKindServer, req.Header.Get(traceparentHeader))
+			req.Header.Set(traceparentHeader, span.traceparent())
+		}
+
+		iw := &instrumentedWriter{
+			ResponseWriter: w,
+			operation:      operation,
+			suffix:         mux.Vars(req)["suffix"],
+			status:         http.StatusOK,
+		}
+		authenticated := false
+		rb.authenticate(func(w http.ResponseWriter, req *http.Request) {
+			authenticated = true
+			if err := checkAPIVersion(req.Header); err != nil {
+				rb.respondError(w, "api-version", err)
+				return
+			}
+			handle(rb, w, req)
+		})(iw, req)
+
+		backend := strings.Join(iw.backends, ",")
+		suffix := b.suffixLabel(iw, authenticated)
+		for _, labels := range iw.backendErrors {
+			labels.suffix = suffix
+			b.Metrics.countBackendError(labels)
+		}
+		b.Metrics.observeRequest(requestLabels{
+			operation: operation,
+			suffix:    suffix,
+			backend:   backend,
+			status:    strconv.Itoa(iw.status),
+		}, time.Since(start).Seconds())
+		if span != nil {
+			span.Attributes["operation"] = operation
+			span.Attributes["suffix"] = iw.suffix
+			span.Attributes["backend"] = backend
+			span.Attributes["request_id"] = id
+			if err := b.Tracer.end(span, iw.status, nil); err != nil {
+				rb.Logger.Error("trace-export", err)
+			}
+		}
+	}
+}
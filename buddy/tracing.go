@@ -0,0 +1,180 @@
+package buddy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader identifies a request across the platform, buddy and the
+// backend brokers
+const requestIDHeader = "X-Broker-API-Request-Identity"
+
+// traceparentHeader carries the trace context the W3C way:
+// 00-<trace-id>-<parent-span-id>-<flags>
+const traceparentHeader = "traceparent"
+
+const (
+	spanKindServer = "server"
+	spanKindClient = "client"
+)
+
+// requestID is the platform's ID of a request, or a new one when it has none
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return newUUID()
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	data := randomBytes(16)
+	data[6] = (data[6] & 0x0f) | 0x40
+	data[8] = (data[8] & 0x3f) | 0x80
+	return formatUUID(data)
+}
+
+func formatUUID(data []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16])
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Span is one timed step of a request, in the shape of an OpenTelemetry span
+type Span struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	Status       string                 `json:"status"`
+	Attributes   map[string]interface{} `json:"attributes"`
+}
+
+// traceparent is the trace context passing this span on as the parent
+func (s *Span) traceparent() string {
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+// SpanExporter receives every finished span
+type SpanExporter interface {
+	ExportSpan(span Span) error
+}
+
+type writerSpanExporter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterSpanExporter writes spans to w as JSON lines
+func NewWriterSpanExporter(w io.Writer) SpanExporter {
+	return &writerSpanExporter{writer: w}
+}
+
+// NewFileSpanExporter appends spans to the file at path as JSON lines
+func NewFileSpanExporter(path string) (SpanExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSpanExporter(file), nil
+}
+
+func (e *writerSpanExporter) ExportSpan(span Span) error {
+	data, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.writer.Write(append(data, '\n'))
+	return err
+}
+
+// Tracer starts and exports the spans of requests
+type Tracer struct {
+	Exporter SpanExporter
+}
+
+// start begins a span, continuing the trace of a traceparent header when
+// there is a valid one
+func (t *Tracer) start(name, kind, traceparent string) *Span {
+	span := &Span{
+		TraceID:    hex.EncodeToString(randomBytes(16)),
+		SpanID:     hex.EncodeToString(randomBytes(8)),
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now().UTC(),
+		Attributes: map[string]interface{}{},
+	}
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 && isHex(parts[1]) && isHex(parts[2]) {
+		span.TraceID = parts[1]
+		span.ParentSpanID = parts[2]
+	}
+	return span
+}
+
+// end finishes a span with the HTTP status of its step, exporting it
+func (t *Tracer) end(span *Span, status int, err error) error {
+	span.EndTime = time.Now().UTC()
+	span.Status = "ok"
+	if status != 0 {
+		span.Attributes["http.status_code"] = status
+	}
+	if err != nil {
+		span.Status = "error"
+		span.Attributes["error"] = err.Error()
+	} else if status >= 500 {
+		span.Status = "error"
+	}
+	return t.Exporter.ExportSpan(*span)
+}
+
+func isHex(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// tracingTransport wraps every call to a backend broker in a client span,
+// passing the span on to the backend as the parent of its own spans
+type tracingTransport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := t.tracer.start("backend "+req.Method, spanKindClient, req.Header.Get(traceparentHeader))
+	if backend, ok := req.Context().Value(backendContextKey{}).(string); ok {
+		span.Attributes["backend"] = backend
+	}
+	span.Attributes["http.method"] = req.Method
+	span.Attributes["http.url"] = req.URL.String()
+	span.Attributes["request_id"] = req.Header.Get(requestIDHeader)
+
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, span.traceparent())
+	resp, err := t.next.RoundTrip(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	t.tracer.end(span, status, err)
+	return resp, err
+}
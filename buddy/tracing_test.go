@@ -0,0 +1,159 @@
+package buddy_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		tmpDir    string
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+		logs      *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "buddy-tracing")
+		Ω(err).ShouldNot(HaveOccurred())
+		backend = ghttp.NewServer()
+		logs = &bytes.Buffer{}
+		config = Config{
+			Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}},
+			LogLevel: "debug",
+		}
+	})
+
+	JustBeforeEach(func() {
+		Ω(config.Validate()).Should(Succeed())
+		brokerAPI = NewWithConfig(NewLogger("buddy-tracing-tests", config, logs), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	makeRequest := func(header http.Header) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("PUT", "/space1/v2/service_instances/instance1",
+			bytes.NewBufferString(`{"service_id":"redis-space1","plan_id":"small-space1"}`))
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("Test request IDs", func() {
+		It("passes the platform's request ID on", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("X-Broker-API-Request-Identity", "platform-request"),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest(http.Header{"X-Broker-Api-Request-Identity": {"platform-request"}})
+
+			Ω(response.Code).Should(Equal(201))
+			Ω(response.Header().Get("X-Broker-API-Request-Identity")).Should(Equal("platform-request"))
+			Ω(logs.String()).Should(ContainSubstring(`"request_id":"platform-request"`))
+		})
+
+		It("gives requests without one a new request ID", func() {
+			var backendRequestID string
+			backend.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				backendRequestID = req.Header.Get("X-Broker-API-Request-Identity")
+				w.WriteHeader(201)
+			})
+
+			response := makeRequest(nil)
+
+			requestID := response.Header().Get("X-Broker-API-Request-Identity")
+			Ω(requestID).Should(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			Ω(backendRequestID).Should(Equal(requestID))
+			Ω(logs.String()).Should(ContainSubstring(`"request_id":"` + requestID + `"`))
+		})
+	})
+
+	Describe("Test spans", func() {
+		var spansFile string
+
+		BeforeEach(func() {
+			spansFile = filepath.Join(tmpDir, "spans.json")
+			config.Tracing = &TracingConfig{Output: spansFile}
+		})
+
+		readSpans := func() []Span {
+			file, err := os.Open(spansFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			var spans []Span
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var span Span
+				Ω(json.Unmarshal(scanner.Bytes(), &span)).Should(Succeed())
+				spans = append(spans, span)
+			}
+			return spans
+		}
+
+		It("exports the request and its backend call in one trace", func() {
+			var traceparent string
+			backend.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				traceparent = req.Header.Get("traceparent")
+				w.WriteHeader(201)
+			})
+
+			makeRequest(http.Header{"X-Broker-Api-Request-Identity": {"platform-request"}})
+
+			spans := readSpans()
+			Ω(spans).Should(HaveLen(2))
+			client, server := spans[0], spans[1]
+			Ω(server.Name).Should(Equal("osb provision"))
+			Ω(server.Kind).Should(Equal("server"))
+			Ω(server.Attributes).Should(HaveKeyWithValue("backend", "redis"))
+			Ω(server.Attributes).Should(HaveKeyWithValue("request_id", "platform-request"))
+			Ω(server.Attributes).Should(HaveKeyWithValue("http.status_code", BeNumerically("==", 201)))
+			Ω(client.Name).Should(Equal("backend PUT"))
+			Ω(client.Kind).Should(Equal("client"))
+			Ω(client.TraceID).Should(Equal(server.TraceID))
+			Ω(client.ParentSpanID).Should(Equal(server.SpanID))
+			Ω(traceparent).Should(Equal("00-" + client.TraceID + "-" + client.SpanID + "-01"))
+		})
+
+		It("continues the platform's trace", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+
+			makeRequest(http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}})
+
+			spans := readSpans()
+			Ω(spans).Should(HaveLen(2))
+			Ω(spans[1].TraceID).Should(Equal("0af7651916cd43dd8448eb211c80319c"))
+			Ω(spans[1].ParentSpanID).Should(Equal("b7ad6b7169203331"))
+		})
+
+		It("marks failed backend calls", func() {
+			backend.AppendHandlers(ghttp.RespondWith(502, "{}"))
+
+			makeRequest(nil)
+
+			spans := readSpans()
+			Ω(spans).Should(HaveLen(2))
+			Ω(spans[0].Status).Should(Equal("error"))
+		})
+	})
+})
@@ -0,0 +1,181 @@
+package buddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const apiVersionHeader = "X-Broker-API-Version"
+
+// apiVersion is an OSB API version; the zero value is an unknown version
+type apiVersion struct {
+	Major int
+	Minor int
+}
+
+var (
+	// brokerAPIVersion is the newest OSB API version buddy knows, which it
+	// advertises to platforms
+	brokerAPIVersion = apiVersion{2, 16}
+	// retrievableVersion added fetching instances and bindings
+	retrievableVersion = apiVersion{2, 14}
+	// asyncBindingsVersion added asynchronous bindings
+	asyncBindingsVersion = apiVersion{2, 14}
+)
+
+// parseAPIVersion reads a version like 2.14
+func parseAPIVersion(value string) (apiVersion, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return apiVersion{}, fmt.Errorf("%q is no API version like 2.14", value)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 1 {
+		return apiVersion{}, fmt.Errorf("%q is no API version like 2.14", value)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return apiVersion{}, fmt.Errorf("%q is no API version like 2.14", value)
+	}
+	return apiVersion{Major: major, Minor: minor}, nil
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func (v apiVersion) known() bool {
+	return v != apiVersion{}
+}
+
+// olderThan is true for known versions before other
+func (v apiVersion) olderThan(other apiVersion) bool {
+	if !v.known() {
+		return false
+	}
+	return v.Major < other.Major || (v.Major == other.Major && v.Minor < other.Minor)
+}
+
+// platformVersion is the version a platform's request declares, unknown when
+// it declares none buddy understands
+func platformVersion(header http.Header) apiVersion {
+	version, _ := parseAPIVersion(header.Get(apiVersionHeader))
+	return version
+}
+
+// checkAPIVersion rejects requests of platforms speaking another major
+// version than buddy. Requests without a version are let through.
+func checkAPIVersion(header http.Header) error {
+	value := header.Get(apiVersionHeader)
+	if value == "" {
+		return nil
+	}
+	version, err := parseAPIVersion(value)
+	if err != nil {
+		return rejectf(http.StatusPreconditionFailed, "%s: %s", apiVersionHeader, err)
+	}
+	if version.Major != brokerAPIVersion.Major {
+		return rejectf(http.StatusPreconditionFailed, "API version %s is not supported, buddy speaks %s", version, brokerAPIVersion)
+	}
+	return nil
+}
+
+// backendAPIVersion is the version to declare to a backend broker: the
+// platform's, but at most the one the backend speaks
+func backendAPIVersion(backend backendBroker, platform http.Header) apiVersion {
+	version := platformVersion(platform)
+	if !version.known() || backend.APIVersion.olderThan(version) {
+		return backend.APIVersion
+	}
+	return version
+}
+
+// versionedField is a response field and the API version that added it
+type versionedField struct {
+	version apiVersion
+	name    string
+}
+
+var (
+	catalogServiceFields = []versionedField{
+		{apiVersion{2, 14}, "instances_retrievable"},
+		{apiVersion{2, 14}, "bindings_retrievable"},
+		{apiVersion{2, 16}, "allow_context_updates"},
+	}
+	catalogPlanFields = []versionedField{
+		{apiVersion{2, 15}, "maintenance_info"},
+		{apiVersion{2, 15}, "maximum_polling_duration"},
+	}
+	// responseFields are the fields of OSB responses by operation
+	responseFields = map[string][]versionedField{
+		"provision":      {{apiVersion{2, 16}, "metadata"}},
+		"update":         {{apiVersion{2, 16}, "metadata"}},
+		"last_operation": {{apiVersion{2, 15}, "instance_usable"}, {apiVersion{2, 15}, "update_repeatable"}},
+		"bind":           {{apiVersion{2, 16}, "metadata"}},
+		"fetch_instance": {{apiVersion{2, 15}, "maintenance_info"}, {apiVersion{2, 16}, "metadata"}},
+		"fetch_binding":  {{apiVersion{2, 16}, "metadata"}},
+	}
+)
+
+// downgradeFields removes the fields a platform's version doesn't know yet,
+// telling whether there were any
+func downgradeFields(fields rawObject, versioned []versionedField, platform apiVersion) bool {
+	changed := false
+	for _, field := range versioned {
+		if _, ok := fields[field.name]; ok && platform.olderThan(field.version) {
+			delete(fields, field.name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// downgradeResponse turns successful responses into the shape of the
+// platform's version. Responses are only buffered when the platform is older
+// than a field of the operation.
+var downgradeResponse = ResponseRewriterFunc(func(call *Call, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil
+	}
+	versioned := responseFields[call.Operation]
+	older := false
+	for _, field := range versioned {
+		older = older || call.platformVersion.olderThan(field.version)
+	}
+	if !older {
+		return nil
+	}
+	data, err := responseBody(resp)
+	if err != nil {
+		return err
+	}
+	var fields rawObject
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil
+	}
+	if !downgradeFields(fields, versioned, call.platformVersion) {
+		return nil
+	}
+	data, err = marshalJSON(fields)
+	if err != nil {
+		return err
+	}
+	setResponseBody(resp, data)
+	return nil
+})
+
+// translateCatalogService emulates the features a backend broker's version
+// lacks in one of its services, and removes the fields the platform's version
+// doesn't know yet
+func (b AppHandler) translateCatalogService(service rawObject, plans []rawObject, backend backendBroker, platform apiVersion) {
+	if backend.APIVersion.olderThan(retrievableVersion) && b.Registry != nil {
+		service["instances_retrievable"] = json.RawMessage("true")
+	}
+	downgradeFields(service, catalogServiceFields, platform)
+	for _, plan := range plans {
+		downgradeFields(plan, catalogPlanFields, platform)
+	}
+}
@@ -0,0 +1,235 @@
+package buddy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/buddy-broker/buddy"
+	"github.com/pivotal-golang/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("API versions", func() {
+	var (
+		backend   *ghttp.Server
+		brokerAPI http.Handler
+		config    Config
+	)
+
+	BeforeEach(func() {
+		backend = ghttp.NewServer()
+		backend.RouteToHandler("GET", "/v2/catalog", ghttp.RespondWith(200,
+			`{"services":[{"id":"redis","name":"redis","bindings_retrievable":false,"plans":[{"id":"small","name":"small","maintenance_info":{"version":"1.0.0"}}]}]}`))
+		config = Config{Backends: []BackendConfig{{Name: "redis", URL: backend.URL()}}}
+	})
+
+	JustBeforeEach(func() {
+		brokerAPI = NewWithConfig(lager.NewLogger("buddy-version-tests"), config)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	makeRequest := func(method, path, version, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if version != "" {
+			request.Header.Set("X-Broker-API-Version", version)
+		}
+		brokerAPI.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	services := func(response *httptest.ResponseRecorder) []map[string]json.RawMessage {
+		Ω(response.Code).Should(Equal(200))
+		var catalog struct {
+			Services []map[string]json.RawMessage `json:"services"`
+		}
+		Ω(json.Unmarshal(response.Body.Bytes(), &catalog)).Should(Succeed())
+		return catalog.Services
+	}
+
+	Describe("Test platform versions", func() {
+		It("advertises buddy's version", func() {
+			response := makeRequest("GET", "/redis/v2/catalog", "2.14", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Header().Get("X-Broker-API-Version")).Should(Equal("2.16"))
+		})
+
+		It("rejects other major versions", func() {
+			response := makeRequest("GET", "/redis/v2/catalog", "3.0", "")
+
+			Ω(response.Code).Should(Equal(412))
+			Ω(backend.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("rejects malformed versions", func() {
+			response := makeRequest("GET", "/redis/v2/catalog", "latest", "")
+
+			Ω(response.Code).Should(Equal(412))
+		})
+
+		It("passes the platform's version on when the backend's is not configured", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("X-Broker-API-Version", "2.16"),
+				ghttp.RespondWith(201, "{}"),
+			))
+
+			response := makeRequest("PUT", "/redis/v2/service_instances/instance1", "2.16", `{"service_id":"redis-redis","plan_id":"small-redis"}`)
+
+			Ω(response.Code).Should(Equal(201))
+		})
+
+		It("removes catalog fields newer than the platform's version", func() {
+			service := services(makeRequest("GET", "/redis/v2/catalog", "2.13", ""))[0]
+
+			Ω(service).ShouldNot(HaveKey("bindings_retrievable"))
+			Ω(service["plans"]).Should(MatchJSON(`[{"id":"small-redis","name":"small"}]`))
+		})
+
+		It("removes response fields newer than the platform's version", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"state":"succeeded","instance_usable":true}`))
+
+			response := makeRequest("GET", "/redis/v2/service_instances/instance1/last_operation", "2.14", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"state":"succeeded"}`))
+		})
+
+		It("keeps response fields without a platform version", func() {
+			backend.AppendHandlers(ghttp.RespondWith(200, `{"state":"succeeded","instance_usable":true}`))
+
+			response := makeRequest("GET", "/redis/v2/service_instances/instance1/last_operation", "", "")
+
+			Ω(response.Body).Should(MatchJSON(`{"state":"succeeded","instance_usable":true}`))
+		})
+	})
+
+	Describe("Test older backends", func() {
+		BeforeEach(func() {
+			config.Backends[0].APIVersion = "2.13"
+		})
+
+		JustBeforeEach(func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, "{}"))
+			Ω(makeRequest("PUT", "/redis/v2/service_instances/instance1", "2.16", `{"service_id":"redis-redis","plan_id":"small-redis"}`).Code).Should(Equal(201))
+		})
+
+		It("declares at most the backend's version", func() {
+			backend.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeaderKV("X-Broker-API-Version", "2.13"),
+					ghttp.RespondWith(200, "{}"),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeaderKV("X-Broker-API-Version", "2.12"),
+					ghttp.RespondWith(200, "{}"),
+				),
+			)
+
+			Ω(makeRequest("PATCH", "/redis/v2/service_instances/instance1", "2.16", `{"service_id":"redis-redis"}`).Code).Should(Equal(200))
+			Ω(makeRequest("PATCH", "/redis/v2/service_instances/instance1", "2.12", `{"service_id":"redis-redis"}`).Code).Should(Equal(200))
+		})
+
+		It("offers fetching instances from buddy's records", func() {
+			service := services(makeRequest("GET", "/redis/v2/catalog", "2.16", ""))[0]
+			Ω(service["instances_retrievable"]).Should(MatchJSON(`true`))
+
+			response := makeRequest("GET", "/redis/v2/service_instances/instance1", "2.16", "")
+
+			Ω(response.Code).Should(Equal(200))
+			Ω(response.Body).Should(MatchJSON(`{"service_id":"redis-redis","plan_id":"small-redis"}`))
+			Ω(backend.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("binds asynchronously for the platform", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("PUT", "/v2/service_instances/instance1/service_bindings/binding1", ""),
+				ghttp.RespondWith(201, `{"credentials":{"password":"secret"}}`),
+			))
+
+			response := makeRequest("PUT", "/redis/v2/service_instances/instance1/service_bindings/binding1?accepts_incomplete=true", "2.16",
+				`{"service_id":"redis-redis","plan_id":"small-redis"}`)
+			Ω(response.Code).Should(Equal(202))
+			var accepted struct {
+				Operation string `json:"operation"`
+			}
+			Ω(json.Unmarshal(response.Body.Bytes(), &accepted)).Should(Succeed())
+			Ω(accepted.Operation).ShouldNot(BeEmpty())
+
+			lastOperation := func() string {
+				return makeRequest("GET", "/redis/v2/service_instances/instance1/service_bindings/binding1/last_operation?operation="+accepted.Operation, "2.16", "").Body.String()
+			}
+			Eventually(lastOperation).Should(MatchJSON(`{"state":"succeeded"}`))
+
+			fetch := makeRequest("GET", "/redis/v2/service_instances/instance1/service_bindings/binding1", "2.16", "")
+			Ω(fetch.Code).Should(Equal(200))
+			Ω(fetch.Body).Should(MatchJSON(`{"credentials":{"password":"secret"}}`))
+			Ω(makeRequest("GET", "/redis/v2/service_instances/instance1/service_bindings/binding1", "2.16", "").Body).Should(MatchJSON(`{}`))
+		})
+
+		It("reports failed asynchronous binds", func() {
+			backend.AppendHandlers(ghttp.RespondWith(400, `{"description":"no more bindings"}`))
+
+			response := makeRequest("PUT", "/redis/v2/service_instances/instance1/service_bindings/binding1?accepts_incomplete=true", "2.16",
+				`{"service_id":"redis-redis","plan_id":"small-redis"}`)
+			Ω(response.Code).Should(Equal(202))
+			var accepted struct {
+				Operation string `json:"operation"`
+			}
+			Ω(json.Unmarshal(response.Body.Bytes(), &accepted)).Should(Succeed())
+
+			Eventually(func() string {
+				return makeRequest("GET", "/redis/v2/service_instances/instance1/service_bindings/binding1/last_operation?operation="+accepted.Operation, "2.16", "").Body.String()
+			}).Should(MatchJSON(`{"state":"failed","description":"no more bindings"}`))
+		})
+
+		It("unbinds asynchronously for the platform", func() {
+			backend.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("DELETE", "/v2/service_instances/instance1/service_bindings/binding1", "plan_id=small&service_id=redis"),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			response := makeRequest("DELETE", "/redis/v2/service_instances/instance1/service_bindings/binding1?accepts_incomplete=true&service_id=redis-redis&plan_id=small-redis", "2.16", "")
+			Ω(response.Code).Should(Equal(202))
+			var accepted struct {
+				Operation string `json:"operation"`
+			}
+			Ω(json.Unmarshal(response.Body.Bytes(), &accepted)).Should(Succeed())
+
+			Eventually(func() string {
+				return makeRequest("GET", "/redis/v2/service_instances/instance1/service_bindings/binding1/last_operation?operation="+accepted.Operation, "2.16", "").Body.String()
+			}).Should(MatchJSON(`{"state":"succeeded"}`))
+		})
+
+		It("binds synchronously when the platform doesn't accept asynchronous answers", func() {
+			backend.AppendHandlers(ghttp.RespondWith(201, `{"credentials":{}}`))
+
+			response := makeRequest("PUT", "/redis/v2/service_instances/instance1/service_bindings/binding1", "2.16",
+				`{"service_id":"redis-redis","plan_id":"small-redis"}`)
+
+			Ω(response.Code).Should(Equal(201))
+		})
+	})
+
+	Describe("Test config", func() {
+		It("rejects malformed backend versions", func() {
+			config.Backends[0].APIVersion = "two"
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring(`api_version "two" is no API version like 2.14`)))
+		})
+
+		It("rejects other major backend versions", func() {
+			config.Backends[0].APIVersion = "3.0"
+
+			Ω(config.Validate()).Should(MatchError(ContainSubstring("api_version must be 2.x")))
+		})
+	})
+})
@@ -0,0 +1,59 @@
+package cloudcontroller
+
+import "fmt"
+
+// Org is a Cloud Foundry organization
+type Org struct {
+	GUID string
+	Name string
+}
+
+// Space is a Cloud Foundry space
+type Space struct {
+	GUID    string
+	Name    string
+	OrgGUID string
+}
+
+// Broker is a service broker registered with the Cloud Controller
+type Broker struct {
+	GUID      string
+	Name      string
+	URL       string
+	SpaceGUID string
+}
+
+// BrokerRequest is what to register a space-scoped broker with. Updates
+// without a username and password keep the broker's credentials.
+type BrokerRequest struct {
+	SpaceGUID string
+	Name      string
+	URL       string
+	Username  string
+	Password  string
+}
+
+// API is the part of the Cloud Controller API used to register brokers,
+// independent of the API version
+type API interface {
+	// Orgs lists all organizations, or only the one called name if it is set
+	Orgs(name string) ([]Org, error)
+	Spaces(org Org) ([]Space, error)
+	SpaceBrokers(space Space) ([]Broker, error)
+	// Brokers lists the brokers of all spaces and the global ones
+	Brokers() ([]Broker, error)
+	CreateBroker(broker BrokerRequest) error
+	UpdateBroker(guid string, broker BrokerRequest) error
+	DeleteBroker(guid string) error
+}
+
+// NewAPI returns the API of a version, "v2" or "v3"
+func NewAPI(client *Client, version string) (API, error) {
+	switch version {
+	case "v2":
+		return &v2API{client: client}, nil
+	case "v3":
+		return &v3API{client: client}, nil
+	}
+	return nil, fmt.Errorf("Unknown Cloud Controller API version %q, use v2 or v3", version)
+}
@@ -0,0 +1,225 @@
+package cloudcontroller
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// requestTimeout limits every Cloud Controller and UAA request, so a stuck
+// API fails a sync instead of hanging it
+const requestTimeout = time.Minute
+
+// Client talks to the Cloud Controller API with an access token, the way `cf curl` does
+type Client struct {
+	URL        string
+	Token      string
+	HTTPClient *http.Client
+	// Refresh gets a new access token when the Cloud Controller rejects the
+	// current one, e.g. because it expired; without it rejections are errors
+	Refresh *TokenRefresh
+}
+
+// TokenRefresh is what it takes to get a new access token from UAA, the way
+// the cf CLI does
+type TokenRefresh struct {
+	UAAURL       string
+	RefreshToken string
+	ClientID     string
+	ClientSecret string
+}
+
+// Error is a Cloud Controller response that was not successful
+type Error struct {
+	Method string
+	Path   string
+	Status int
+	Body   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, strings.TrimSpace(e.Body))
+}
+
+// NewClient returns a client for the Cloud Controller at url
+func NewClient(url, token string, skipSSLValidation bool) *Client {
+	client := &http.Client{Timeout: requestTimeout}
+	if skipSSLValidation {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return &Client{
+		URL:        strings.TrimRight(url, "/"),
+		Token:      token,
+		HTTPClient: client,
+	}
+}
+
+// cfConfig are the fields of the cf CLI config buddy needs
+type cfConfig struct {
+	Target               string
+	AccessToken          string
+	RefreshToken         string
+	UaaEndpoint          string
+	UAAOAuthClient       string
+	UAAOAuthClientSecret string
+	SSLDisabled          bool
+}
+
+// NewClientFromCFConfig returns a client for the API the cf CLI is logged in
+// to, reading $CF_HOME/.cf/config.json or ~/.cf/config.json. The client
+// refreshes the access token with the cf CLI's refresh token, so it keeps
+// working after the access token expired.
+func NewClientFromCFConfig() (*Client, error) {
+	home := os.Getenv("CF_HOME")
+	if home == "" {
+		home = os.Getenv("HOME")
+	}
+	path := filepath.Join(home, ".cf", "config.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read cf CLI config, run `cf login` first: %s", err)
+	}
+	var config cfConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Could not parse cf CLI config %s: %s", path, err)
+	}
+	if config.Target == "" || config.AccessToken == "" {
+		return nil, fmt.Errorf("cf CLI is not logged in, run `cf login` first")
+	}
+	client := NewClient(config.Target, config.AccessToken, config.SSLDisabled)
+	if config.RefreshToken != "" && config.UaaEndpoint != "" {
+		clientID := config.UAAOAuthClient
+		if clientID == "" {
+			clientID = "cf"
+		}
+		client.Refresh = &TokenRefresh{
+			UAAURL:       strings.TrimRight(config.UaaEndpoint, "/"),
+			RefreshToken: config.RefreshToken,
+			ClientID:     clientID,
+			ClientSecret: config.UAAOAuthClientSecret,
+		}
+	}
+	return client, nil
+}
+
+// refreshToken replaces the access token with a new one from UAA
+func (c *Client) refreshToken() error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", c.Refresh.RefreshToken)
+	req, err := http.NewRequest("POST", c.Refresh.UAAURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Refresh.ClientID, c.Refresh.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not refresh the access token: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Could not refresh the access token: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not refresh the access token, run `cf login` again: %d %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil || token.AccessToken == "" {
+		return fmt.Errorf("Could not refresh the access token: unexpected response %s", strings.TrimSpace(string(data)))
+	}
+	c.Token = token.AccessToken
+	if token.RefreshToken != "" {
+		c.Refresh.RefreshToken = token.RefreshToken
+	}
+	return nil
+}
+
+// Get fetches path, which may be relative to the API or a full URL as found
+// in pagination links, and decodes the JSON response into out
+func (c *Client) Get(path string, out interface{}) error {
+	_, err := c.Do("GET", path, nil, out)
+	return err
+}
+
+// Do sends body as JSON and decodes the JSON response into out if it is not
+// nil. It returns the response headers, e.g. to follow v3 job locations. A
+// request rejected with 401 is sent once more after refreshing the token.
+func (c *Client) Do(method, path string, body interface{}, out interface{}) (http.Header, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	resp, data, err := c.send(method, path, payload)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.Refresh != nil {
+		if err := c.refreshToken(); err != nil {
+			return nil, err
+		}
+		resp, data, err = c.send(method, path, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &Error{Method: method, Path: path, Status: resp.StatusCode, Body: string(data)}
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *Client) send(method, path string, payload []byte) (*http.Response, []byte, error) {
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = c.URL + path
+	}
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := c.Token
+	if !strings.HasPrefix(strings.ToLower(token), "bearer ") {
+		token = "bearer " + token
+	}
+	req.Header.Set("Authorization", token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, data, nil
+}
@@ -0,0 +1,119 @@
+package cloudcontroller
+
+import (
+	"fmt"
+	"net/url"
+)
+
+type v2API struct {
+	client *Client
+}
+
+type v2Page struct {
+	NextURL   *string `json:"next_url"`
+	Resources []struct {
+		Metadata struct {
+			GUID string `json:"guid"`
+		} `json:"metadata"`
+		Entity struct {
+			Name      string `json:"name"`
+			BrokerURL string `json:"broker_url"`
+			SpaceGUID string `json:"space_guid"`
+			OrgGUID   string `json:"organization_guid"`
+		} `json:"entity"`
+	} `json:"resources"`
+}
+
+// each walks all pages starting at path
+func (api *v2API) each(path string, fn func(page v2Page)) error {
+	next := &path
+	for next != nil {
+		var page v2Page
+		if err := api.client.Get(*next, &page); err != nil {
+			return err
+		}
+		fn(page)
+		next = page.NextURL
+	}
+	return nil
+}
+
+func (api *v2API) Orgs(name string) ([]Org, error) {
+	path := "/v2/organizations"
+	if name != "" {
+		path += "?q=" + url.QueryEscape("name:"+name)
+	}
+	orgs := []Org{}
+	err := api.each(path, func(page v2Page) {
+		for _, resource := range page.Resources {
+			orgs = append(orgs, Org{GUID: resource.Metadata.GUID, Name: resource.Entity.Name})
+		}
+	})
+	return orgs, err
+}
+
+func (api *v2API) Spaces(org Org) ([]Space, error) {
+	spaces := []Space{}
+	err := api.each(fmt.Sprintf("/v2/organizations/%s/spaces", org.GUID), func(page v2Page) {
+		for _, resource := range page.Resources {
+			spaces = append(spaces, Space{GUID: resource.Metadata.GUID, Name: resource.Entity.Name, OrgGUID: org.GUID})
+		}
+	})
+	return spaces, err
+}
+
+func (api *v2API) SpaceBrokers(space Space) ([]Broker, error) {
+	return api.brokers("/v2/service_brokers?q=" + url.QueryEscape("space_guid:"+space.GUID))
+}
+
+func (api *v2API) Brokers() ([]Broker, error) {
+	return api.brokers("/v2/service_brokers")
+}
+
+func (api *v2API) brokers(path string) ([]Broker, error) {
+	brokers := []Broker{}
+	err := api.each(path, func(page v2Page) {
+		for _, resource := range page.Resources {
+			brokers = append(brokers, Broker{
+				GUID:      resource.Metadata.GUID,
+				Name:      resource.Entity.Name,
+				URL:       resource.Entity.BrokerURL,
+				SpaceGUID: resource.Entity.SpaceGUID,
+			})
+		}
+	})
+	return brokers, err
+}
+
+type v2BrokerBody struct {
+	SpaceGUID    string `json:"space_guid"`
+	Name         string `json:"name"`
+	BrokerURL    string `json:"broker_url"`
+	AuthUsername string `json:"auth_username,omitempty"`
+	AuthPassword string `json:"auth_password,omitempty"`
+}
+
+func newV2BrokerBody(broker BrokerRequest) v2BrokerBody {
+	return v2BrokerBody{
+		SpaceGUID:    broker.SpaceGUID,
+		Name:         broker.Name,
+		BrokerURL:    broker.URL,
+		AuthUsername: broker.Username,
+		AuthPassword: broker.Password,
+	}
+}
+
+func (api *v2API) CreateBroker(broker BrokerRequest) error {
+	_, err := api.client.Do("POST", "/v2/service_brokers", newV2BrokerBody(broker), nil)
+	return err
+}
+
+func (api *v2API) UpdateBroker(guid string, broker BrokerRequest) error {
+	_, err := api.client.Do("PUT", "/v2/service_brokers/"+guid, newV2BrokerBody(broker), nil)
+	return err
+}
+
+func (api *v2API) DeleteBroker(guid string) error {
+	_, err := api.client.Do("DELETE", "/v2/service_brokers/"+guid, nil, nil)
+	return err
+}
@@ -0,0 +1,206 @@
+package cloudcontroller
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type v3API struct {
+	client *Client
+}
+
+type v3Page struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []struct {
+		GUID          string `json:"guid"`
+		Name          string `json:"name"`
+		URL           string `json:"url"`
+		Relationships struct {
+			Space struct {
+				Data *struct {
+					GUID string `json:"guid"`
+				} `json:"data"`
+			} `json:"space"`
+		} `json:"relationships"`
+	} `json:"resources"`
+}
+
+// each walks all pages starting at path
+func (api *v3API) each(path string, fn func(page v3Page)) error {
+	for path != "" {
+		var page v3Page
+		if err := api.client.Get(path, &page); err != nil {
+			return err
+		}
+		fn(page)
+		path = ""
+		if page.Pagination.Next != nil {
+			path = page.Pagination.Next.Href
+		}
+	}
+	return nil
+}
+
+func (api *v3API) Orgs(name string) ([]Org, error) {
+	path := "/v3/organizations"
+	if name != "" {
+		path += "?names=" + url.QueryEscape(name)
+	}
+	orgs := []Org{}
+	err := api.each(path, func(page v3Page) {
+		for _, resource := range page.Resources {
+			orgs = append(orgs, Org{GUID: resource.GUID, Name: resource.Name})
+		}
+	})
+	return orgs, err
+}
+
+func (api *v3API) Spaces(org Org) ([]Space, error) {
+	spaces := []Space{}
+	err := api.each("/v3/spaces?organization_guids="+url.QueryEscape(org.GUID), func(page v3Page) {
+		for _, resource := range page.Resources {
+			spaces = append(spaces, Space{GUID: resource.GUID, Name: resource.Name, OrgGUID: org.GUID})
+		}
+	})
+	return spaces, err
+}
+
+func (api *v3API) SpaceBrokers(space Space) ([]Broker, error) {
+	return api.brokers("/v3/service_brokers?space_guids=" + url.QueryEscape(space.GUID))
+}
+
+func (api *v3API) Brokers() ([]Broker, error) {
+	return api.brokers("/v3/service_brokers")
+}
+
+func (api *v3API) brokers(path string) ([]Broker, error) {
+	brokers := []Broker{}
+	err := api.each(path, func(page v3Page) {
+		for _, resource := range page.Resources {
+			broker := Broker{GUID: resource.GUID, Name: resource.Name, URL: resource.URL}
+			if resource.Relationships.Space.Data != nil {
+				broker.SpaceGUID = resource.Relationships.Space.Data.GUID
+			}
+			brokers = append(brokers, broker)
+		}
+	})
+	return brokers, err
+}
+
+type v3Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type v3Authentication struct {
+	Type        string        `json:"type"`
+	Credentials v3Credentials `json:"credentials"`
+}
+
+type v3Relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3BrokerRelationships struct {
+	Space v3Relationship `json:"space"`
+}
+
+type v3BrokerBody struct {
+	Name           string                 `json:"name"`
+	URL            string                 `json:"url"`
+	Authentication *v3Authentication      `json:"authentication,omitempty"`
+	Relationships  *v3BrokerRelationships `json:"relationships,omitempty"`
+}
+
+func newV3BrokerBody(broker BrokerRequest) v3BrokerBody {
+	body := v3BrokerBody{Name: broker.Name, URL: broker.URL}
+	if broker.Username != "" || broker.Password != "" {
+		body.Authentication = &v3Authentication{
+			Type:        "basic",
+			Credentials: v3Credentials{Username: broker.Username, Password: broker.Password},
+		}
+	}
+	return body
+}
+
+// CreateBroker registers the broker and waits for the Cloud Controller to
+// fetch its catalog
+func (api *v3API) CreateBroker(broker BrokerRequest) error {
+	body := newV3BrokerBody(broker)
+	body.Relationships = &v3BrokerRelationships{}
+	body.Relationships.Space.Data.GUID = broker.SpaceGUID
+	return api.doJob("POST", "/v3/service_brokers", body)
+}
+
+// UpdateBroker updates the broker and waits for the catalog to be fetched
+// again; a broker can't move to another space
+func (api *v3API) UpdateBroker(guid string, broker BrokerRequest) error {
+	return api.doJob("PATCH", "/v3/service_brokers/"+guid, newV3BrokerBody(broker))
+}
+
+// DeleteBroker deletes the broker and waits until it is gone
+func (api *v3API) DeleteBroker(guid string) error {
+	return api.doJob("DELETE", "/v3/service_brokers/"+guid, nil)
+}
+
+const (
+	jobFirstPoll   = 100 * time.Millisecond
+	jobMaxPoll     = 5 * time.Second
+	jobMaxDuration = 5 * time.Minute
+)
+
+type v3Job struct {
+	GUID   string `json:"guid"`
+	State  string `json:"state"`
+	Errors []struct {
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+// doJob sends a request the Cloud Controller answers with a job and polls
+// the job at its Location until it is complete. Failed jobs are errors.
+func (api *v3API) doJob(method, path string, body interface{}) error {
+	header, err := api.client.Do(method, path, body, nil)
+	if err != nil {
+		return err
+	}
+	location := header.Get("Location")
+	if location == "" {
+		return nil
+	}
+
+	wait := jobFirstPoll
+	deadline := time.Now().Add(jobMaxDuration)
+	for {
+		var job v3Job
+		if err := api.client.Get(location, &job); err != nil {
+			return err
+		}
+		switch job.State {
+		case "COMPLETE":
+			return nil
+		case "FAILED":
+			details := []string{}
+			for _, jobErr := range job.Errors {
+				details = append(details, jobErr.Detail)
+			}
+			return fmt.Errorf("%s %s: job %s failed: %s", method, path, job.GUID, strings.Join(details, "; "))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s %s: job %s still %s after %s", method, path, job.GUID, job.State, jobMaxDuration)
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > jobMaxPoll {
+			wait = jobMaxPoll
+		}
+	}
+}
@@ -11,4 +11,5 @@ require (
 	github.com/onsi/gomega v0.0.0-20160222031234-a1094b2db2d4
 	github.com/pivotal-cf/brokerapi v0.0.0-20161028102657-3dcb3e88faf1
 	github.com/pivotal-golang/lager v0.0.0-20160311180000-7639e31ce662
+	gopkg.in/yaml.v2 v2.4.0
 )
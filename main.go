@@ -1,22 +1,61 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/cloudfoundry-community/buddy-broker/buddy"
 	"github.com/pivotal-golang/lager"
 )
 
 func main() {
-	logger := lager.NewLogger("buddy-broker")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "register":
+			os.Exit(register(os.Args[2:]))
+		case "sync":
+			os.Exit(sync(os.Args[2:]))
+		case "validate-config":
+			os.Exit(validateConfig(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %s, use register, sync, validate-config or no command to run the broker\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
+	flags := flag.NewFlagSet("buddy-broker", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("BUDDY_CONFIG"), "YAML or JSON config file (default: $BUDDY_CONFIG, else BACKEND_BROKER* env vars)")
+	flags.Parse(os.Args[1:])
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger := buddy.NewLogger("buddy-broker", config, os.Stdout)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
 
-	buddyAPI := buddy.New(logger)
+	buddyAPI := buddy.NewWithConfig(logger, config)
 	http.Handle("/", buddyAPI)
+	logger.Info("listen", lager.Data{"port": port})
 	logger.Fatal("http-listen", http.ListenAndServe(fmt.Sprintf("0.0.0.0:%s", port), nil))
 }
+
+// loadConfig reads the config file if there is one, and the env vars otherwise
+func loadConfig(configFile string) (buddy.Config, error) {
+	if configFile != "" {
+		return buddy.LoadConfig(configFile)
+	}
+	config := buddy.ConfigFromEnv()
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("environment: %s", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cloudfoundry-community/buddy-broker/cloudcontroller"
+	"github.com/cloudfoundry-community/buddy-broker/registrar"
+)
+
+const registerUsage = `USAGE: buddy-broker register [flags] broker-name username password baseurl
+       buddy-broker register -generate-credentials [flags] broker-name baseurl
+
+Registers buddy as a space-scoped broker "<broker-name>-<org>-<space>" with
+URL "<baseurl>/<org>-<space>" in every space, updating it where it exists.
+Everything in org and space names but letters, digits and dots is written
+as _ and its hex code in the URL, e.g. my-space as my_2dspace.
+Uses the API and token of the cf CLI unless -api and -token are given.
+With -generate-credentials every new broker gets its own credentials,
+generated through the buddy admin API; existing brokers keep theirs unless
+-rotate-credentials is given.
+
+`
+
+// cloudControllerFlags are the flags of every subcommand talking to the Cloud Controller
+type cloudControllerFlags struct {
+	api               string
+	token             string
+	apiVersion        string
+	skipSSLValidation bool
+}
+
+func (f *cloudControllerFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.api, "api", "", "Cloud Controller URL (default: cf CLI target)")
+	flags.StringVar(&f.token, "token", "", "Cloud Controller access token (default: cf CLI token)")
+	flags.StringVar(&f.apiVersion, "api-version", "v3", "Cloud Controller API version, v2 or v3")
+	flags.BoolVar(&f.skipSSLValidation, "skip-ssl-validation", false, "skip Cloud Controller certificate validation")
+}
+
+// credentialsFlags are the flags of every subcommand generating per-space credentials
+type credentialsFlags struct {
+	generate      bool
+	rotate        bool
+	adminURL      string
+	adminUsername string
+	adminPassword string
+}
+
+func (f *credentialsFlags) register(flags *flag.FlagSet) {
+	flags.BoolVar(&f.generate, "generate-credentials", false, "generate broker credentials for every space")
+	flags.BoolVar(&f.rotate, "rotate-credentials", false, "with -generate-credentials, rotate the credentials of existing brokers too")
+	flags.StringVar(&f.adminURL, "admin-url", "", "buddy admin API URL (default: baseurl)")
+	flags.StringVar(&f.adminUsername, "admin-username", os.Getenv("ADMIN_USERNAME"), "buddy admin API username (default: $ADMIN_USERNAME)")
+	flags.StringVar(&f.adminPassword, "admin-password", os.Getenv("ADMIN_PASSWORD"), "buddy admin API password (default: $ADMIN_PASSWORD)")
+}
+
+// parseArgs fills opts from the positional args: broker-name username
+// password baseurl, or broker-name baseurl when credentials are generated
+func (f *credentialsFlags) parseArgs(flags *flag.FlagSet, opts *registrar.Options) bool {
+	if f.rotate && !f.generate {
+		return false
+	}
+	opts.RotateCredentials = f.rotate
+	if f.generate {
+		if flags.NArg() != 2 {
+			return false
+		}
+		opts.BaseName = flags.Arg(0)
+		opts.BaseURL = flags.Arg(1)
+		return true
+	}
+	if flags.NArg() != 4 {
+		return false
+	}
+	opts.BaseName = flags.Arg(0)
+	opts.Username = flags.Arg(1)
+	opts.Password = flags.Arg(2)
+	opts.BaseURL = flags.Arg(3)
+	return true
+}
+
+func (f *credentialsFlags) newCredentials(baseURL string) (registrar.Credentials, error) {
+	if !f.generate {
+		return nil, nil
+	}
+	if f.adminUsername == "" || f.adminPassword == "" {
+		return nil, fmt.Errorf("-admin-username and -admin-password are required to generate credentials")
+	}
+	adminURL := f.adminURL
+	if adminURL == "" {
+		adminURL = baseURL
+	}
+	return registrar.NewAdminClient(adminURL, f.adminUsername, f.adminPassword), nil
+}
+
+func (f *cloudControllerFlags) newAPI() (cloudcontroller.API, error) {
+	var client *cloudcontroller.Client
+	if f.api != "" || f.token != "" {
+		if f.api == "" || f.token == "" {
+			return nil, fmt.Errorf("-api and -token must be given together")
+		}
+		client = cloudcontroller.NewClient(f.api, f.token, f.skipSSLValidation)
+	} else {
+		var err error
+		client, err = cloudcontroller.NewClientFromCFConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cloudcontroller.NewAPI(client, f.apiVersion)
+}
+
+func register(args []string) int {
+	flags := flag.NewFlagSet("register", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, registerUsage)
+		flags.PrintDefaults()
+	}
+	var ccFlags cloudControllerFlags
+	ccFlags.register(flags)
+	var credFlags credentialsFlags
+	credFlags.register(flags)
+	var opts registrar.Options
+	flags.StringVar(&opts.Org, "org", os.Getenv("ORG"), "only register in this organization (default: $ORG)")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "print what would change without changing it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !credFlags.parseArgs(flags, &opts) {
+		flags.Usage()
+		return 2
+	}
+
+	api, err := ccFlags.newAPI()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	credentials, err := credFlags.newCredentials(opts.BaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	r := &registrar.Registrar{API: api, Out: os.Stdout, Credentials: credentials}
+	if err := r.Register(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
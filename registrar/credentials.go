@@ -0,0 +1,95 @@
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Credentials generates the broker credentials of each suffix
+type Credentials interface {
+	// Generate creates the credentials of a suffix, or rotates them when
+	// they exist, and returns the new ones. Only new brokers and explicit
+	// rotations call it.
+	Generate(suffix string) (username, password string, err error)
+	// Revoke removes the credentials of a suffix
+	Revoke(suffix string) error
+}
+
+// AdminClient manages credentials through the admin API of a buddy broker
+type AdminClient struct {
+	URL        string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// NewAdminClient returns a client of the buddy admin API at url
+func NewAdminClient(url, username, password string) *AdminClient {
+	return &AdminClient{
+		URL:        strings.TrimRight(url, "/"),
+		Username:   username,
+		Password:   password,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type credentialResponse struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Generate creates the credentials of a suffix, rotating existing ones
+func (c *AdminClient) Generate(suffix string) (string, string, error) {
+	path := "/admin/credentials/" + url.PathEscape(suffix)
+	status, data, err := c.do("POST", path)
+	if err == nil && status == http.StatusConflict {
+		status, data, err = c.do("POST", path+"/rotate")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if status != http.StatusCreated && status != http.StatusOK {
+		return "", "", fmt.Errorf("Could not generate credentials for %s: %d %s", suffix, status, data)
+	}
+	var credential credentialResponse
+	if err := json.Unmarshal(data, &credential); err != nil {
+		return "", "", fmt.Errorf("Could not parse credentials for %s: %s", suffix, err)
+	}
+	return credential.Username, credential.Password, nil
+}
+
+// Revoke removes the credentials of a suffix; credentials that are already
+// gone are fine
+func (c *AdminClient) Revoke(suffix string) error {
+	status, data, err := c.do("DELETE", "/admin/credentials/"+url.PathEscape(suffix))
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("Could not revoke credentials for %s: %d %s", suffix, status, data)
+	}
+	return nil
+}
+
+func (c *AdminClient) do(method, path string) (int, []byte, error) {
+	req, err := http.NewRequest(method, c.URL+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s %s: %s", method, path, err)
+	}
+	return resp.StatusCode, data, nil
+}
@@ -0,0 +1,204 @@
+package registrar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudfoundry-community/buddy-broker/cloudcontroller"
+)
+
+// Options describe the buddy broker to register in every space
+type Options struct {
+	BaseName string
+	Username string
+	Password string
+	BaseURL  string
+	// Org limits registration to one organization when set
+	Org string
+	// DryRun prints what would change without changing anything
+	DryRun bool
+	// RotateCredentials generates new credentials for existing brokers too.
+	// Otherwise only new brokers get generated credentials and existing ones
+	// keep theirs.
+	RotateCredentials bool
+}
+
+// Suffix is the buddy suffix a space is served under. Buddy keeps instances
+// and credentials apart by suffix, so no two spaces may share one: the org
+// and space names are escaped, making the dash between them unambiguous and
+// the suffix safe in a URL path.
+func Suffix(org, space string) string {
+	return escapeName(org) + "-" + escapeName(space)
+}
+
+// escapeName keeps letters, digits and dots and writes every other byte as
+// _ and its hex code, e.g. my-space as my_2dspace
+func escapeName(name string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' {
+			escaped.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&escaped, "_%02x", c)
+	}
+	return escaped.String()
+}
+
+// BrokerName is the name of the buddy broker registered in a space
+func BrokerName(baseName, org, space string) string {
+	return baseName + "-" + org + "-" + space
+}
+
+// BrokerURL is the buddy URL registered in a space
+func BrokerURL(baseURL, org, space string) string {
+	return strings.TrimRight(baseURL, "/") + "/" + Suffix(org, space)
+}
+
+// Registrar registers buddy as a space-scoped broker in every space
+type Registrar struct {
+	API cloudcontroller.API
+	Out io.Writer
+	// Credentials, when set, generates the broker credentials of each space
+	// instead of registering Options.Username and Options.Password everywhere
+	Credentials Credentials
+}
+
+// Register creates the broker in every space that doesn't have it yet and
+// updates it where it exists, so running it twice changes nothing
+func (r *Registrar) Register(opts Options) error {
+	orgs, err := r.API.Orgs(opts.Org)
+	if err != nil {
+		return err
+	}
+	if opts.Org != "" && len(orgs) == 0 {
+		return fmt.Errorf("Organization %s not found", opts.Org)
+	}
+	brokers, err := r.API.Brokers()
+	if err != nil {
+		return err
+	}
+	claims := claimedURLs(brokers, opts.BaseURL)
+	claimed := map[string]string{}
+	for _, org := range orgs {
+		fmt.Fprintf(r.Out, "%s ...\n", org.Name)
+		spaces, err := r.API.Spaces(org)
+		if err != nil {
+			return err
+		}
+		for _, space := range spaces {
+			if err := claimSuffix(claimed, Suffix(org.Name, space.Name), space); err != nil {
+				return err
+			}
+			if err := r.registerSpace(opts, org, space, claims); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// claimSuffix records which space a suffix is for, failing when another
+// space already has it
+func claimSuffix(claimed map[string]string, suffix string, space cloudcontroller.Space) error {
+	if guid, ok := claimed[suffix]; ok && guid != space.GUID {
+		return fmt.Errorf("Spaces %s and %s would share suffix %s", guid, space.GUID, suffix)
+	}
+	claimed[suffix] = space.GUID
+	return nil
+}
+
+func (r *Registrar) registerSpace(opts Options, org cloudcontroller.Org, space cloudcontroller.Space, claims map[string]*cloudcontroller.Broker) error {
+	broker := r.brokerRequest(opts, org, space)
+	fmt.Fprintf(r.Out, "%s / %s\n", org.Name, space.Name)
+
+	existing, found, err := r.findBroker(broker, space)
+	if err != nil {
+		return err
+	}
+	if found {
+		if opts.DryRun {
+			fmt.Fprintf(r.Out, "Would update broker %s %s\n", existing.Name, broker.URL)
+			return nil
+		}
+		fmt.Fprintf(r.Out, "Broker already exists %s - updating...\n", existing.Name)
+		if err := r.updateCredentials(opts, &broker); err != nil {
+			return err
+		}
+		return r.API.UpdateBroker(existing.GUID, broker)
+	}
+	if owner := claims[broker.URL]; owner != nil {
+		return fmt.Errorf("Suffix of %s is held by broker %s of space %s, e.g. after a rename; not registering it", broker.URL, owner.Name, owner.SpaceGUID)
+	}
+	if opts.DryRun {
+		fmt.Fprintf(r.Out, "Would create broker %s %s\n", broker.Name, broker.URL)
+		return nil
+	}
+	fmt.Fprintf(r.Out, "Creating broker %s %s...\n", broker.Name, broker.URL)
+	if err := r.generateCredentials(opts, &broker); err != nil {
+		return err
+	}
+	return r.API.CreateBroker(broker)
+}
+
+// generateCredentials replaces the broker credentials with generated ones
+// for the suffix of its URL
+func (r *Registrar) generateCredentials(opts Options, broker *cloudcontroller.BrokerRequest) error {
+	if r.Credentials == nil {
+		return nil
+	}
+	username, password, err := r.Credentials.Generate(suffixOf(opts.BaseURL, broker.URL))
+	if err != nil {
+		return err
+	}
+	broker.Username = username
+	broker.Password = password
+	return nil
+}
+
+// updateCredentials picks the credentials an existing broker is updated
+// with: the given ones, newly rotated ones when asked for, or none, so the
+// broker keeps the credentials it was generated. Rotating locks the broker
+// out until the update is done.
+func (r *Registrar) updateCredentials(opts Options, broker *cloudcontroller.BrokerRequest) error {
+	if r.Credentials == nil {
+		return nil
+	}
+	if opts.RotateCredentials {
+		return r.generateCredentials(opts, broker)
+	}
+	broker.Username = ""
+	broker.Password = ""
+	return nil
+}
+
+// suffixOf is the buddy suffix of a broker URL below baseURL
+func suffixOf(baseURL, brokerURL string) string {
+	return strings.TrimPrefix(brokerURL, strings.TrimRight(baseURL, "/")+"/")
+}
+
+func (r *Registrar) brokerRequest(opts Options, org cloudcontroller.Org, space cloudcontroller.Space) cloudcontroller.BrokerRequest {
+	return cloudcontroller.BrokerRequest{
+		SpaceGUID: space.GUID,
+		Name:      BrokerName(opts.BaseName, org.Name, space.Name),
+		URL:       BrokerURL(opts.BaseURL, org.Name, space.Name),
+		Username:  opts.Username,
+		Password:  opts.Password,
+	}
+}
+
+// findBroker looks for the buddy broker of a space by name or URL
+func (r *Registrar) findBroker(broker cloudcontroller.BrokerRequest, space cloudcontroller.Space) (cloudcontroller.Broker, bool, error) {
+	brokers, err := r.API.SpaceBrokers(space)
+	if err != nil {
+		return cloudcontroller.Broker{}, false, err
+	}
+	for _, existing := range brokers {
+		if existing.Name == broker.Name || existing.URL == broker.URL {
+			return existing, true, nil
+		}
+	}
+	return cloudcontroller.Broker{}, false, nil
+}
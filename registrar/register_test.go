@@ -0,0 +1,202 @@
+package registrar_test
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/cloudfoundry-community/buddy-broker/cloudcontroller"
+	. "github.com/cloudfoundry-community/buddy-broker/registrar"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Register", func() {
+	var (
+		cc   *ghttp.Server
+		out  *bytes.Buffer
+		opts Options
+	)
+
+	BeforeEach(func() {
+		cc = ghttp.NewServer()
+		cc.AllowUnhandledRequests = false
+		out = &bytes.Buffer{}
+		opts = Options{BaseName: "redis", Username: "user", Password: "pass", BaseURL: "https://buddy.example.com/"}
+	})
+
+	AfterEach(func() {
+		cc.Close()
+	})
+
+	newRegistrar := func(version string) *Registrar {
+		api, err := cloudcontroller.NewAPI(cloudcontroller.NewClient(cc.URL(), "token", false), version)
+		Ω(err).ShouldNot(HaveOccurred())
+		return &Registrar{API: api, Out: out}
+	}
+
+	Describe("Test v3 API", func() {
+		BeforeEach(func() {
+			cc.RouteToHandler("GET", "/v3/organizations", ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "bearer token"),
+				ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"org1-guid","name":"org1"}]}`),
+			))
+			cc.RouteToHandler("GET", "/v3/spaces", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"space1-guid","name":"space1"},{"guid":"space2-guid","name":"space2"}]}`))
+			cc.RouteToHandler("GET", "/v3/service_brokers", func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("space_guids") == "space2-guid" {
+					w.Write([]byte(`{"pagination":{"next":null},"resources":[{"guid":"broker2-guid","name":"redis-org1-space2","url":"https://buddy.example.com/org1-space2"}]}`))
+					return
+				}
+				w.Write([]byte(`{"pagination":{"next":null},"resources":[]}`))
+			})
+		})
+
+		It("creates missing brokers and updates existing ones", func() {
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space1","url":"https://buddy.example.com/org1-space1","authentication":{"type":"basic","credentials":{"username":"user","password":"pass"}},"relationships":{"space":{"data":{"guid":"space1-guid"}}}}`),
+				ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/create-job"}}),
+			))
+			cc.RouteToHandler("PATCH", "/v3/service_brokers/broker2-guid", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space2","url":"https://buddy.example.com/org1-space2","authentication":{"type":"basic","credentials":{"username":"user","password":"pass"}}}`),
+				ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/update-job"}}),
+			))
+			polls := 0
+			cc.RouteToHandler("GET", "/v3/jobs/create-job", func(w http.ResponseWriter, req *http.Request) {
+				polls++
+				if polls == 1 {
+					w.Write([]byte(`{"guid":"create-job","state":"PROCESSING"}`))
+					return
+				}
+				w.Write([]byte(`{"guid":"create-job","state":"COMPLETE"}`))
+			})
+			cc.RouteToHandler("GET", "/v3/jobs/update-job", ghttp.RespondWith(200, `{"guid":"update-job","state":"COMPLETE"}`))
+
+			Ω(newRegistrar("v3").Register(opts)).Should(Succeed())
+
+			Ω(out.String()).Should(ContainSubstring("Creating broker redis-org1-space1 https://buddy.example.com/org1-space1"))
+			Ω(out.String()).Should(ContainSubstring("Broker already exists redis-org1-space2 - updating..."))
+			Ω(polls).Should(Equal(2))
+		})
+
+		It("reports failed jobs", func() {
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/create-job"}}))
+			cc.RouteToHandler("GET", "/v3/jobs/create-job", ghttp.RespondWith(200, `{"guid":"create-job","state":"FAILED","errors":[{"title":"CF-ServiceBrokerCatalogInvalid","detail":"Service broker catalog is invalid"}]}`))
+
+			err := newRegistrar("v3").Register(opts)
+
+			Ω(err).Should(MatchError("POST /v3/service_brokers: job create-job failed: Service broker catalog is invalid"))
+		})
+
+		It("follows pagination and filters by org", func() {
+			cc.RouteToHandler("GET", "/v3/organizations", func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.URL.Query().Get("names")).Should(Equal("org1"))
+				if req.URL.Query().Get("page") == "" {
+					w.Write([]byte(`{"pagination":{"next":{"href":"` + cc.URL() + `/v3/organizations?names=org1&page=2"}},"resources":[{"guid":"org1-guid","name":"org1"}]}`))
+					return
+				}
+				w.Write([]byte(`{"pagination":{"next":null},"resources":[{"guid":"org2-guid","name":"org2"}]}`))
+			})
+			opts.Org = "org1"
+			opts.DryRun = true
+
+			Ω(newRegistrar("v3").Register(opts)).Should(Succeed())
+			Ω(out.String()).Should(ContainSubstring("org1 ..."))
+			Ω(out.String()).Should(ContainSubstring("org2 ..."))
+		})
+
+		It("changes nothing in a dry run", func() {
+			opts.DryRun = true
+
+			Ω(newRegistrar("v3").Register(opts)).Should(Succeed())
+
+			Ω(out.String()).Should(ContainSubstring("Would create broker redis-org1-space1 https://buddy.example.com/org1-space1"))
+			Ω(out.String()).Should(ContainSubstring("Would update broker redis-org1-space2 https://buddy.example.com/org1-space2"))
+			for _, req := range cc.ReceivedRequests() {
+				Ω(req.Method).Should(Equal("GET"))
+			}
+		})
+
+		It("escapes names in suffixes", func() {
+			cc.RouteToHandler("GET", "/v3/spaces", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"space3-guid","name":"my space/dev-1"}]}`))
+			opts.DryRun = true
+
+			Ω(newRegistrar("v3").Register(opts)).Should(Succeed())
+
+			Ω(out.String()).Should(ContainSubstring("Would create broker redis-org1-my space/dev-1 https://buddy.example.com/org1-my_20space_2fdev_2d1"))
+		})
+
+		It("fails when two spaces would share a suffix", func() {
+			cc.RouteToHandler("GET", "/v3/spaces", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"space1-guid","name":"space1"},{"guid":"space9-guid","name":"space1"}]}`))
+			opts.DryRun = true
+
+			Ω(newRegistrar("v3").Register(opts)).Should(MatchError("Spaces space1-guid and space9-guid would share suffix org1-space1"))
+		})
+
+		It("fails for spaces whose suffix another space's broker holds", func() {
+			cc.RouteToHandler("GET", "/v3/service_brokers", func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("space_guids") != "" {
+					w.Write([]byte(`{"pagination":{"next":null},"resources":[]}`))
+					return
+				}
+				w.Write([]byte(`{"pagination":{"next":null},"resources":[{"guid":"broker9-guid","name":"redis-org1-renamed","url":"https://buddy.example.com/org1-space1","relationships":{"space":{"data":{"guid":"space9-guid"}}}}]}`))
+			})
+			opts.DryRun = true
+
+			err := newRegistrar("v3").Register(opts)
+
+			Ω(err).Should(MatchError(ContainSubstring("Suffix of https://buddy.example.com/org1-space1 is held by broker redis-org1-renamed of space space9-guid")))
+		})
+
+		It("fails for an unknown org", func() {
+			cc.RouteToHandler("GET", "/v3/organizations", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[]}`))
+			opts.Org = "missing"
+
+			Ω(newRegistrar("v3").Register(opts)).Should(MatchError("Organization missing not found"))
+		})
+	})
+
+	Describe("Test v2 API", func() {
+		It("creates missing brokers and updates existing ones", func() {
+			cc.RouteToHandler("GET", "/v2/organizations", ghttp.RespondWith(200, `{"next_url":null,"resources":[{"metadata":{"guid":"org1-guid"},"entity":{"name":"org1"}}]}`))
+			cc.RouteToHandler("GET", "/v2/organizations/org1-guid/spaces", ghttp.RespondWith(200, `{"next_url":null,"resources":[{"metadata":{"guid":"space1-guid"},"entity":{"name":"space1"}},{"metadata":{"guid":"space2-guid"},"entity":{"name":"space2"}}]}`))
+			cc.RouteToHandler("GET", "/v2/service_brokers", func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("q") == "space_guid:space2-guid" {
+					w.Write([]byte(`{"next_url":null,"resources":[{"metadata":{"guid":"broker2-guid"},"entity":{"name":"other","broker_url":"https://buddy.example.com/org1-space2"}}]}`))
+					return
+				}
+				w.Write([]byte(`{"next_url":null,"resources":[]}`))
+			})
+			cc.RouteToHandler("POST", "/v2/service_brokers", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"space_guid":"space1-guid","name":"redis-org1-space1","broker_url":"https://buddy.example.com/org1-space1","auth_username":"user","auth_password":"pass"}`),
+				ghttp.RespondWith(201, "{}"),
+			))
+			cc.RouteToHandler("PUT", "/v2/service_brokers/broker2-guid", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"space_guid":"space2-guid","name":"redis-org1-space2","broker_url":"https://buddy.example.com/org1-space2","auth_username":"user","auth_password":"pass"}`),
+				ghttp.RespondWith(200, "{}"),
+			))
+
+			Ω(newRegistrar("v2").Register(opts)).Should(Succeed())
+
+			Ω(out.String()).Should(ContainSubstring("Creating broker redis-org1-space1"))
+			Ω(out.String()).Should(ContainSubstring("Broker already exists other - updating..."))
+		})
+
+		It("reports Cloud Controller errors", func() {
+			cc.RouteToHandler("GET", "/v2/organizations", ghttp.RespondWith(401, `{"description":"Invalid Auth Token"}`))
+
+			err := newRegistrar("v2").Register(opts)
+
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("401"))
+		})
+	})
+
+	Describe("Test suffixes", func() {
+		It("keeps the org and space apart", func() {
+			Ω(Suffix("a-b", "c")).ShouldNot(Equal(Suffix("a", "b-c")))
+			Ω(Suffix("a_2d", "b")).ShouldNot(Equal(Suffix("a-", "b")))
+			Ω(Suffix("org1", "space.1")).Should(Equal("org1-space.1"))
+		})
+	})
+})
@@ -0,0 +1,207 @@
+package registrar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/buddy-broker/cloudcontroller"
+)
+
+// OutdatedBroker is a buddy broker whose name or URL no longer matches its
+// space
+type OutdatedBroker struct {
+	Broker  cloudcontroller.Broker
+	Desired cloudcontroller.BrokerRequest
+}
+
+// Drift is how the registered buddy brokers differ from the spaces
+type Drift struct {
+	// Missing are spaces without a buddy broker
+	Missing []cloudcontroller.BrokerRequest
+	// Outdated are buddy brokers with the right URL but a stale name
+	Outdated []OutdatedBroker
+	// Renamed are buddy brokers whose URL holds the suffix of a space's old
+	// name. Buddy keeps instances and credentials by suffix, so a new URL
+	// would cut the space off from them; renames are only reported.
+	Renamed []OutdatedBroker
+	// Claimed are spaces without a buddy broker whose suffix the buddy
+	// broker of another space holds, e.g. of a space renamed away from the
+	// name. Registering them would let both spaces share instances and
+	// credentials, so they are only reported.
+	Claimed []OutdatedBroker
+	// Orphaned are buddy brokers left behind in spaces that no longer exist
+	Orphaned []cloudcontroller.Broker
+}
+
+// Empty is true when nothing needs to change
+func (d Drift) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Outdated) == 0 && len(d.Renamed) == 0 && len(d.Claimed) == 0 && len(d.Orphaned) == 0
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%d missing, %d outdated, %d renamed, %d claimed, %d orphaned", len(d.Missing), len(d.Outdated), len(d.Renamed), len(d.Claimed), len(d.Orphaned))
+}
+
+// Drift compares the buddy brokers, recognised by their URL starting with
+// BaseURL, with the spaces they should be registered in. Orphans are only
+// looked for among brokers of deleted spaces, so an Org filter never touches
+// brokers of other orgs.
+func (r *Registrar) Drift(opts Options) (Drift, error) {
+	var drift Drift
+	orgs, err := r.API.Orgs("")
+	if err != nil {
+		return drift, err
+	}
+	brokers, err := r.API.Brokers()
+	if err != nil {
+		return drift, err
+	}
+	baseURL := strings.TrimRight(opts.BaseURL, "/") + "/"
+	spaceBrokers := map[string][]cloudcontroller.Broker{}
+	for _, broker := range brokers {
+		if broker.SpaceGUID != "" && strings.HasPrefix(broker.URL, baseURL) {
+			spaceBrokers[broker.SpaceGUID] = append(spaceBrokers[broker.SpaceGUID], broker)
+		}
+	}
+	claims := claimedURLs(brokers, opts.BaseURL)
+
+	spaceGUIDs := map[string]bool{}
+	claimed := map[string]string{}
+	for _, org := range orgs {
+		spaces, err := r.API.Spaces(org)
+		if err != nil {
+			return drift, err
+		}
+		for _, space := range spaces {
+			spaceGUIDs[space.GUID] = true
+			if err := claimSuffix(claimed, Suffix(org.Name, space.Name), space); err != nil {
+				return drift, err
+			}
+			if opts.Org != "" && opts.Org != org.Name {
+				continue
+			}
+			desired := r.brokerRequest(opts, org, space)
+			existing := spaceBrokers[space.GUID]
+			switch {
+			case len(existing) == 0 && claims[desired.URL] != nil:
+				drift.Claimed = append(drift.Claimed, OutdatedBroker{Broker: *claims[desired.URL], Desired: desired})
+			case len(existing) == 0:
+				drift.Missing = append(drift.Missing, desired)
+			case hasBroker(existing, desired):
+			case brokerWithURL(existing, desired.URL) != nil:
+				drift.Outdated = append(drift.Outdated, OutdatedBroker{Broker: *brokerWithURL(existing, desired.URL), Desired: desired})
+			default:
+				drift.Renamed = append(drift.Renamed, OutdatedBroker{Broker: existing[0], Desired: desired})
+			}
+		}
+	}
+
+	for _, broker := range brokers {
+		if broker.SpaceGUID != "" && strings.HasPrefix(broker.URL, baseURL) && !spaceGUIDs[broker.SpaceGUID] {
+			drift.Orphaned = append(drift.Orphaned, broker)
+		}
+	}
+	return drift, nil
+}
+
+// claimedURLs are the buddy brokers of spaces by their URL
+func claimedURLs(brokers []cloudcontroller.Broker, baseURL string) map[string]*cloudcontroller.Broker {
+	prefix := strings.TrimRight(baseURL, "/") + "/"
+	claims := map[string]*cloudcontroller.Broker{}
+	for i, broker := range brokers {
+		if broker.SpaceGUID != "" && strings.HasPrefix(broker.URL, prefix) {
+			claims[broker.URL] = &brokers[i]
+		}
+	}
+	return claims
+}
+
+func hasBroker(brokers []cloudcontroller.Broker, desired cloudcontroller.BrokerRequest) bool {
+	for _, broker := range brokers {
+		if broker.Name == desired.Name && broker.URL == desired.URL {
+			return true
+		}
+	}
+	return false
+}
+
+func brokerWithURL(brokers []cloudcontroller.Broker, url string) *cloudcontroller.Broker {
+	for i := range brokers {
+		if brokers[i].URL == url {
+			return &brokers[i]
+		}
+	}
+	return nil
+}
+
+// Sync reports the drift and, unless DryRun is set, fixes it. Brokers of
+// renamed spaces are left for an operator to move.
+func (r *Registrar) Sync(opts Options) (Drift, error) {
+	drift, err := r.Drift(opts)
+	if err != nil {
+		return drift, err
+	}
+	fmt.Fprintf(r.Out, "drift: %s\n", drift)
+
+	for _, broker := range drift.Missing {
+		fmt.Fprintf(r.Out, "missing: %s %s\n", broker.Name, broker.URL)
+		if !opts.DryRun {
+			if err := r.generateCredentials(opts, &broker); err != nil {
+				return drift, err
+			}
+			if err := r.API.CreateBroker(broker); err != nil {
+				return drift, err
+			}
+		}
+	}
+	for _, outdated := range drift.Outdated {
+		fmt.Fprintf(r.Out, "outdated: %s %s => %s %s\n", outdated.Broker.Name, outdated.Broker.URL, outdated.Desired.Name, outdated.Desired.URL)
+		if !opts.DryRun {
+			desired := outdated.Desired
+			if err := r.updateCredentials(opts, &desired); err != nil {
+				return drift, err
+			}
+			if err := r.API.UpdateBroker(outdated.Broker.GUID, desired); err != nil {
+				return drift, err
+			}
+		}
+	}
+	for _, renamed := range drift.Renamed {
+		fmt.Fprintf(r.Out, "renamed: %s %s => %s %s, not changed\n", renamed.Broker.Name, renamed.Broker.URL, renamed.Desired.Name, renamed.Desired.URL)
+	}
+	for _, claimed := range drift.Claimed {
+		fmt.Fprintf(r.Out, "claimed: %s %s is held by %s of space %s, not registered\n", claimed.Desired.Name, claimed.Desired.URL, claimed.Broker.Name, claimed.Broker.SpaceGUID)
+	}
+	for _, broker := range drift.Orphaned {
+		fmt.Fprintf(r.Out, "orphaned: %s %s\n", broker.Name, broker.URL)
+		if !opts.DryRun {
+			if err := r.API.DeleteBroker(broker.GUID); err != nil {
+				return drift, err
+			}
+			if r.Credentials != nil {
+				if err := r.Credentials.Revoke(suffixOf(opts.BaseURL, broker.URL)); err != nil {
+					return drift, err
+				}
+			}
+		}
+	}
+	return drift, nil
+}
+
+// Run syncs every interval until stop is closed. Failed syncs are reported
+// and retried on the next tick.
+func (r *Registrar) Run(opts Options, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Sync(opts); err != nil {
+			fmt.Fprintf(r.Out, "sync failed: %s\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package registrar_test
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-community/buddy-broker/cloudcontroller"
+	. "github.com/cloudfoundry-community/buddy-broker/registrar"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Sync", func() {
+	var (
+		cc        *ghttp.Server
+		out       *bytes.Buffer
+		opts      Options
+		registrar *Registrar
+	)
+
+	BeforeEach(func() {
+		cc = ghttp.NewServer()
+		out = &bytes.Buffer{}
+		opts = Options{BaseName: "redis", Username: "user", Password: "pass", BaseURL: "https://buddy.example.com"}
+		api, err := cloudcontroller.NewAPI(cloudcontroller.NewClient(cc.URL(), "token", false), "v3")
+		Ω(err).ShouldNot(HaveOccurred())
+		registrar = &Registrar{API: api, Out: out}
+
+		cc.RouteToHandler("GET", "/v3/organizations", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"org1-guid","name":"org1"}]}`))
+		cc.RouteToHandler("GET", "/v3/spaces", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[
+			{"guid":"space1-guid","name":"space1"},
+			{"guid":"space2-guid","name":"space2"},
+			{"guid":"space3-guid","name":"space3"},
+			{"guid":"space4-guid","name":"space4"}
+		]}`))
+		cc.RouteToHandler("GET", "/v3/service_brokers", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[
+			{"guid":"broker2-guid","name":"redis-org1-space2","url":"https://buddy.example.com/org1-space2","relationships":{"space":{"data":{"guid":"space2-guid"}}}},
+			{"guid":"broker3-guid","name":"redis-org1-old","url":"https://buddy.example.com/org1-old","relationships":{"space":{"data":{"guid":"space3-guid"}}}},
+			{"guid":"broker5-guid","name":"redis-legacy","url":"https://buddy.example.com/org1-space4","relationships":{"space":{"data":{"guid":"space4-guid"}}}},
+			{"guid":"broker4-guid","name":"redis-org1-gone","url":"https://buddy.example.com/org1-gone","relationships":{"space":{"data":{"guid":"gone-guid"}}}},
+			{"guid":"other-guid","name":"other","url":"https://other.example.com/org1-gone","relationships":{"space":{"data":{"guid":"gone-guid"}}}},
+			{"guid":"global-guid","name":"redis","url":"https://buddy.example.com/global","relationships":{"space":{"data":null}}}
+		]}`))
+	})
+
+	AfterEach(func() {
+		cc.Close()
+	})
+
+	Describe("Test drift", func() {
+		It("finds missing, outdated, renamed and orphaned brokers", func() {
+			drift, err := registrar.Drift(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(drift.Missing).Should(HaveLen(1))
+			Ω(drift.Missing[0].Name).Should(Equal("redis-org1-space1"))
+			Ω(drift.Outdated).Should(HaveLen(1))
+			Ω(drift.Outdated[0].Broker.GUID).Should(Equal("broker5-guid"))
+			Ω(drift.Outdated[0].Desired.Name).Should(Equal("redis-org1-space4"))
+			Ω(drift.Renamed).Should(HaveLen(1))
+			Ω(drift.Renamed[0].Broker.GUID).Should(Equal("broker3-guid"))
+			Ω(drift.Renamed[0].Desired.URL).Should(Equal("https://buddy.example.com/org1-space3"))
+			Ω(drift.Orphaned).Should(HaveLen(1))
+			Ω(drift.Orphaned[0].GUID).Should(Equal("broker4-guid"))
+		})
+
+		It("doesn't register spaces whose suffix another space's broker holds", func() {
+			cc.RouteToHandler("GET", "/v3/spaces", ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[
+				{"guid":"space3-guid","name":"space3"},
+				{"guid":"space6-guid","name":"old"}
+			]}`))
+
+			drift, err := registrar.Drift(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(drift.Missing).Should(BeEmpty())
+			Ω(drift.Claimed).Should(HaveLen(1))
+			Ω(drift.Claimed[0].Broker.GUID).Should(Equal("broker3-guid"))
+			Ω(drift.Claimed[0].Desired.URL).Should(Equal("https://buddy.example.com/org1-old"))
+		})
+
+		It("ignores other orgs when filtering", func() {
+			opts.Org = "org2"
+
+			drift, err := registrar.Drift(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(drift.Missing).Should(BeEmpty())
+			Ω(drift.Outdated).Should(BeEmpty())
+			Ω(drift.Renamed).Should(BeEmpty())
+			Ω(drift.Orphaned).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Test sync", func() {
+		It("fixes the drift but only reports renamed spaces", func() {
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space1","url":"https://buddy.example.com/org1-space1","authentication":{"type":"basic","credentials":{"username":"user","password":"pass"}},"relationships":{"space":{"data":{"guid":"space1-guid"}}}}`),
+				ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/job1"}}),
+			))
+			cc.RouteToHandler("PATCH", "/v3/service_brokers/broker5-guid", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space4","url":"https://buddy.example.com/org1-space4","authentication":{"type":"basic","credentials":{"username":"user","password":"pass"}}}`),
+				ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/job2"}}),
+			))
+			cc.RouteToHandler("DELETE", "/v3/service_brokers/broker4-guid", ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/job3"}}))
+			cc.RouteToHandler("GET", "/v3/jobs/job1", ghttp.RespondWith(200, `{"guid":"job1","state":"COMPLETE"}`))
+			cc.RouteToHandler("GET", "/v3/jobs/job2", ghttp.RespondWith(200, `{"guid":"job2","state":"COMPLETE"}`))
+			cc.RouteToHandler("GET", "/v3/jobs/job3", ghttp.RespondWith(200, `{"guid":"job3","state":"COMPLETE"}`))
+
+			_, err := registrar.Sync(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(ContainSubstring("drift: 1 missing, 1 outdated, 1 renamed, 0 claimed, 1 orphaned"))
+			Ω(out.String()).Should(ContainSubstring("renamed: redis-org1-old https://buddy.example.com/org1-old => redis-org1-space3 https://buddy.example.com/org1-space3, not changed"))
+			Ω(cc.ReceivedRequests()).Should(HaveLen(9))
+		})
+
+		It("reports brokers the Cloud Controller failed to update", func() {
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.RespondWith(202, "", http.Header{"Location": {cc.URL() + "/v3/jobs/job1"}}))
+			cc.RouteToHandler("GET", "/v3/jobs/job1", ghttp.RespondWith(200, `{"guid":"job1","state":"FAILED","errors":[{"detail":"Service broker catalog is invalid"}]}`))
+
+			_, err := registrar.Sync(opts)
+
+			Ω(err).Should(MatchError("POST /v3/service_brokers: job job1 failed: Service broker catalog is invalid"))
+		})
+
+		It("generates credentials for new brokers and revokes those of removed ones", func() {
+			buddy := ghttp.NewServer()
+			defer buddy.Close()
+			buddy.RouteToHandler("POST", "/admin/credentials/org1-space1", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("admin", "admin-secret"),
+				ghttp.RespondWith(201, `{"suffix":"org1-space1","username":"org1-space1","password":"secret1"}`),
+			))
+			buddy.RouteToHandler("DELETE", "/admin/credentials/org1-gone", ghttp.RespondWith(200, `{}`))
+			registrar.Credentials = NewAdminClient(buddy.URL(), "admin", "admin-secret")
+
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space1","url":"https://buddy.example.com/org1-space1","authentication":{"type":"basic","credentials":{"username":"org1-space1","password":"secret1"}},"relationships":{"space":{"data":{"guid":"space1-guid"}}}}`),
+				ghttp.RespondWith(202, ""),
+			))
+			cc.RouteToHandler("PATCH", "/v3/service_brokers/broker5-guid", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space4","url":"https://buddy.example.com/org1-space4"}`),
+				ghttp.RespondWith(202, ""),
+			))
+			cc.RouteToHandler("DELETE", "/v3/service_brokers/broker4-guid", ghttp.RespondWith(202, ""))
+
+			_, err := registrar.Sync(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(buddy.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("rotates the credentials of fixed brokers when asked to", func() {
+			buddy := ghttp.NewServer()
+			defer buddy.Close()
+			buddy.RouteToHandler("POST", "/admin/credentials/org1-space1", ghttp.CombineHandlers(
+				ghttp.VerifyBasicAuth("admin", "admin-secret"),
+				ghttp.RespondWith(201, `{"suffix":"org1-space1","username":"org1-space1","password":"secret1"}`),
+			))
+			buddy.RouteToHandler("POST", "/admin/credentials/org1-space4", ghttp.RespondWith(409, `{}`))
+			buddy.RouteToHandler("POST", "/admin/credentials/org1-space4/rotate", ghttp.RespondWith(200, `{"suffix":"org1-space4","username":"org1-space4","password":"secret4"}`))
+			buddy.RouteToHandler("DELETE", "/admin/credentials/org1-gone", ghttp.RespondWith(200, `{}`))
+			registrar.Credentials = NewAdminClient(buddy.URL(), "admin", "admin-secret")
+
+			cc.RouteToHandler("POST", "/v3/service_brokers", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space1","url":"https://buddy.example.com/org1-space1","authentication":{"type":"basic","credentials":{"username":"org1-space1","password":"secret1"}},"relationships":{"space":{"data":{"guid":"space1-guid"}}}}`),
+				ghttp.RespondWith(202, ""),
+			))
+			cc.RouteToHandler("PATCH", "/v3/service_brokers/broker5-guid", ghttp.CombineHandlers(
+				ghttp.VerifyJSON(`{"name":"redis-org1-space4","url":"https://buddy.example.com/org1-space4","authentication":{"type":"basic","credentials":{"username":"org1-space4","password":"secret4"}}}`),
+				ghttp.RespondWith(202, ""),
+			))
+			cc.RouteToHandler("DELETE", "/v3/service_brokers/broker4-guid", ghttp.RespondWith(202, ""))
+
+			opts.RotateCredentials = true
+			_, err := registrar.Sync(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(buddy.ReceivedRequests()).Should(HaveLen(4))
+		})
+
+		It("only reports drift in a dry run", func() {
+			opts.DryRun = true
+
+			_, err := registrar.Sync(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(ContainSubstring("orphaned: redis-org1-gone https://buddy.example.com/org1-gone"))
+			for _, req := range cc.ReceivedRequests() {
+				Ω(req.Method).Should(Equal("GET"))
+			}
+		})
+
+		It("refreshes an expired token", func() {
+			uaa := ghttp.NewServer()
+			defer uaa.Close()
+			uaa.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyBasicAuth("cf", ""),
+				ghttp.VerifyFormKV("refresh_token", "refresh"),
+				ghttp.RespondWith(200, `{"access_token":"fresh","refresh_token":"refresh2"}`),
+			))
+			client := cloudcontroller.NewClient(cc.URL(), "expired", false)
+			client.Refresh = &cloudcontroller.TokenRefresh{UAAURL: uaa.URL(), RefreshToken: "refresh", ClientID: "cf"}
+			api, err := cloudcontroller.NewAPI(client, "v3")
+			Ω(err).ShouldNot(HaveOccurred())
+			registrar.API = api
+			opts.DryRun = true
+			orgs := ghttp.RespondWith(200, `{"pagination":{"next":null},"resources":[{"guid":"org1-guid","name":"org1"}]}`)
+			cc.RouteToHandler("GET", "/v3/organizations", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("Authorization") != "bearer fresh" {
+					w.WriteHeader(401)
+					return
+				}
+				orgs(w, req)
+			})
+
+			_, err = registrar.Sync(opts)
+
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(client.Token).Should(Equal("fresh"))
+			Ω(client.Refresh.RefreshToken).Should(Equal("refresh2"))
+		})
+
+		It("keeps syncing until stopped", func() {
+			opts.DryRun = true
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				registrar.Run(opts, 10*time.Millisecond, stop)
+				close(done)
+			}()
+
+			Eventually(func() int { return len(cc.ReceivedRequests()) }).Should(BeNumerically(">=", 6))
+			close(stop)
+			Eventually(done).Should(BeClosed())
+		})
+	})
+})
@@ -3,7 +3,11 @@
 # USAGE: ./scripts/register_service_everywhere.sh dingo-s3 username password baseurl
 # USAGE: ORG=dingotiles ./scripts/register_service_everywhere.sh dingo-s3 username password baseurl
 
-# REQUIREMENTS: jq & cf CLIs
+# USAGE: GENERATE_CREDENTIALS=1 ADMIN_USERNAME=admin ADMIN_PASSWORD=secret ./scripts/register_service_everywhere.sh dingo-s3 - - baseurl
+#        generates broker credentials for every new broker through the buddy admin API at baseurl;
+#        existing brokers keep theirs unless ROTATE_CREDENTIALS=1 is set too
+
+# REQUIREMENTS: jq & cf CLIs (and curl to generate credentials)
 
 base_broker_name=$1; shift
 base_broker_username=$1; shift
@@ -19,6 +23,40 @@ set -e # fail fast
 current_org=$(cat ~/.cf/config.json | jq -r ".OrganizationFields.Name")
 current_space=$(cat ~/.cf/config.json | jq -r ".SpaceFields.Name")
 
+# generate_credentials sets base_broker_username/base_broker_password to new
+# credentials for suffix $1, rotating existing ones
+function generate_credentials() {
+  local admin_url="${base_broker_url%/}/admin/credentials/$1"
+  local response
+  response=$(curl -s -u "${ADMIN_USERNAME}:${ADMIN_PASSWORD}" -X POST "${admin_url}" -w "\n%{http_code}")
+  if [[ "$(echo "${response}" | tail -n1)" == "409" ]]; then
+    response=$(curl -s -u "${ADMIN_USERNAME}:${ADMIN_PASSWORD}" -X POST "${admin_url}/rotate" -w "\n%{http_code}")
+  fi
+  local status=$(echo "${response}" | tail -n1)
+  if [[ "${status}" != "200" && "${status}" != "201" ]]; then
+    echo "Could not generate credentials for $1: ${response}"
+    exit 1
+  fi
+  base_broker_username=$(echo "${response}" | head -n1 | jq -r .username)
+  base_broker_password=$(echo "${response}" | head -n1 | jq -r .password)
+}
+
+# escape_name prints $1 with every byte but letters, digits and dots written
+# as _ and its hex code, so the dash between org and space is unambiguous
+function escape_name() {
+  local LC_ALL=C
+  local name=$1 escaped= c i
+  for (( i = 0; i < ${#name}; i++ )); do
+    c=${name:i:1}
+    if [[ "${c}" =~ [A-Za-z0-9.] ]]; then
+      escaped+=${c}
+    else
+      escaped+=$(printf "_%02x" "'${c}")
+    fi
+  done
+  echo "${escaped}"
+}
+
 echo "Run the following command to return to current org/space:"
 echo "cf target -o \"${current_org}\" -s \"${current_space}\""
 echo
@@ -37,7 +75,8 @@ function update_org() {
       echo ${org_name} "/" ${space_name}
 
       space_broker_name="${base_broker_name}-${org_name}-${space_name}"
-      space_broker_url="${base_broker_url}/${org_name}-${space_name}"
+      space_suffix="$(escape_name "${org_name}")-$(escape_name "${space_name}")"
+      space_broker_url="${base_broker_url}/${space_suffix}"
       space_brokers=$(cf curl "/v2/service_brokers?q=space_guid:${space_guid}")
       space_brokers_count=$(echo $space_brokers | jq -r ".resources | length")
       echo ${space_broker_name} ${space_broker_url} "-" ${space_brokers_count}
@@ -54,8 +93,16 @@ function update_org() {
       done
       if [[ "${space_broker_guid_found}X" == "X" ]]; then
         echo "Creating broker..."
+        if [[ "${GENERATE_CREDENTIALS}X" != "X" ]]; then
+          generate_credentials "${space_suffix}"
+        fi
         cf curl /v2/service_brokers -X POST -d "{\"space_guid\": \"${space_guid}\", \"name\": \"${space_broker_name}\", \"broker_url\": \"${space_broker_url}\", \"auth_username\": \"${base_broker_username}\", \"auth_password\": \"${base_broker_password}\"}" -H "Content-Type: application/x-www-form-urlencoded"
+      elif [[ "${GENERATE_CREDENTIALS}X" != "X" && "${ROTATE_CREDENTIALS}X" == "X" ]]; then
+        cf curl /v2/service_brokers/${space_broker_guid_found} -X PUT -d "{\"space_guid\": \"${space_guid}\", \"name\": \"${space_broker_name}\", \"broker_url\": \"${space_broker_url}\"}" -H "Content-Type: application/x-www-form-urlencoded"
       else
+        if [[ "${GENERATE_CREDENTIALS}X" != "X" ]]; then
+          generate_credentials "${space_suffix}"
+        fi
         cf curl /v2/service_brokers/${space_broker_guid_found} -X PUT -d "{\"space_guid\": \"${space_guid}\", \"name\": \"${space_broker_name}\", \"broker_url\": \"${space_broker_url}\", \"auth_username\": \"${base_broker_username}\", \"auth_password\": \"${base_broker_password}\"}" -H "Content-Type: application/x-www-form-urlencoded"
       fi
     done
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry-community/buddy-broker/registrar"
+)
+
+const syncUsage = `USAGE: buddy-broker sync [flags] broker-name username password baseurl
+       buddy-broker sync -generate-credentials [flags] broker-name baseurl
+
+Keeps buddy registered in every space: every interval it registers
+"<broker-name>-<org>-<space>" in new spaces, fixes stale broker names,
+removes brokers left behind by deleted spaces and reports the drift. Brokers
+of renamed spaces keep their URL and are only reported, and so are new spaces
+whose suffix the broker of another space still holds.
+With -generate-credentials new brokers get generated credentials, fixed ones
+keep theirs unless -rotate-credentials is given, and the credentials of
+removed brokers are revoked.
+
+`
+
+func sync(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, syncUsage)
+		flags.PrintDefaults()
+	}
+	var ccFlags cloudControllerFlags
+	ccFlags.register(flags)
+	var credFlags credentialsFlags
+	credFlags.register(flags)
+	var opts registrar.Options
+	flags.StringVar(&opts.Org, "org", os.Getenv("ORG"), "only register in this organization (default: $ORG)")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "report drift without fixing it")
+	interval := flags.Duration("interval", 5*time.Minute, "time between syncs")
+	once := flags.Bool("once", false, "sync once and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !credFlags.parseArgs(flags, &opts) {
+		flags.Usage()
+		return 2
+	}
+
+	api, err := ccFlags.newAPI()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	credentials, err := credFlags.newCredentials(opts.BaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	r := &registrar.Registrar{API: api, Out: os.Stdout, Credentials: credentials}
+	if *once {
+		if _, err := r.Sync(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	r.Run(opts, *interval, stop)
+	return 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func validateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "USAGE: buddy-broker validate-config [config-file]\n\nChecks a config file, or without one the BACKEND_BROKER* env vars.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	configFile := os.Getenv("BUDDY_CONFIG")
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		configFile = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("config OK: %d backend brokers, %d suffix rules\n", len(config.Backends), len(config.Suffixes))
+	return 0
+}